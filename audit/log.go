@@ -0,0 +1,290 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultRecentSize = 1000
+
+// Bytes read at a time from the end of an existing log.
+const tailChunkSize = 64 * 1024
+
+// One state-changing operation. Old and New hold the JSON encoded values before and after the operation.
+type Entry struct {
+	Sequence  uint64          `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Operation string          `json:"operation"`
+	Peer      string          `json:"peer,omitempty"`
+	Identity  string          `json:"identity,omitempty"`
+	Old       json.RawMessage `json:"old,omitempty"`
+	New       json.RawMessage `json:"new,omitempty"`
+	Result    string          `json:"result"`
+
+	// Each entry is chained to the previous one so that editing or removing a line breaks every hash after it.
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Append-only audit log stored as JSON lines. The most recent entries are also kept in memory for queries. A log
+// without a file only keeps the in-memory entries.
+type Log struct {
+	mutex    sync.Mutex
+	file     *os.File
+	recent   []Entry
+	size     int
+	sequence uint64
+	lastHash string
+}
+
+// Open the log at path, creating it if needed. The most recent entries are read back from the end of the file to
+// continue the hash chain. A final line cut short by a crash is removed from the file and recorded as a
+// RecoverAuditLog entry holding its bytes; blank lines are skipped.
+func Open(path string) (*Log, error) {
+	l := NewMemoryLog()
+	if path == "" {
+		return l, nil
+	}
+
+	var torn []byte
+	unterminated := false
+	existing, err := os.Open(path)
+	if err == nil {
+		var lines [][]byte
+		var rest []byte
+		var size int64
+		lines, rest, size, err = readTail(existing, l.size)
+		_ = existing.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var entry Entry
+			err = json.Unmarshal(line, &entry)
+			if err != nil {
+				return nil, fmt.Errorf("corrupted audit log %s: %s", path, err.Error())
+			}
+			l.remember(entry)
+		}
+
+		var entry Entry
+		switch {
+		case len(bytes.TrimSpace(rest)) == 0:
+			// nothing or only blanks after the last newline
+		case json.Unmarshal(rest, &entry) == nil:
+			// complete entry without its newline
+			l.remember(entry)
+			unterminated = true
+		default:
+			torn = rest
+		}
+		if len(rest) > 0 && !unterminated {
+			err = os.Truncate(path, size-int64(len(rest)))
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if unterminated {
+		_, err = l.file.Write([]byte{'\n'})
+		if err != nil {
+			_ = l.file.Close()
+			return nil, err
+		}
+	}
+	if torn != nil {
+		old, _ := json.Marshal(string(torn))
+		err = l.Record(Entry{
+			Operation: "RecoverAuditLog",
+			Old:       old,
+			Result:    fmt.Sprintf("removed a torn final line of %d bytes", len(torn)),
+		})
+		if err != nil {
+			_ = l.file.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Read the last count lines of f without reading the whole file. lines are the complete lines; rest is whatever
+// follows the last newline. size is the size of the file.
+func readTail(f *os.File, count int) (lines [][]byte, rest []byte, size int64, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	size = info.Size()
+
+	var tail []byte
+	newlines := 0
+	offset := size
+	// one newline more than count, so that the first line in the tail is complete
+	for offset > 0 && newlines <= count {
+		chunk := int64(tailChunkSize)
+		if chunk > offset {
+			chunk = offset
+		}
+		offset -= chunk
+		buffer := make([]byte, chunk)
+		_, err = f.ReadAt(buffer, offset)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		newlines += bytes.Count(buffer, []byte{'\n'})
+		tail = append(buffer, tail...)
+	}
+	if offset > 0 {
+		tail = tail[bytes.IndexByte(tail, '\n')+1:]
+	}
+
+	last := bytes.LastIndexByte(tail, '\n')
+	rest = tail[last+1:]
+	if last < 0 {
+		return nil, rest, size, nil
+	}
+	lines = bytes.Split(tail[:last], []byte{'\n'})
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return lines, rest, size, nil
+}
+
+func NewMemoryLog() *Log {
+	return &Log{
+		size: DefaultRecentSize,
+	}
+}
+
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Append the entry. Sequence, time and hashes are filled in by the log.
+func (l *Log) Record(entry Entry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry.Sequence = l.sequence + 1
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.PrevHash = l.lastHash
+	entry.Hash = ""
+	hash, err := entryHash(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	if l.file != nil {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = l.file.Write(append(line, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+
+	l.remember(entry)
+	return nil
+}
+
+// Up to limit most recent entries, newest first. A zero limit returns everything kept in memory.
+func (l *Log) Recent(limit int) []Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if limit <= 0 || limit > len(l.recent) {
+		limit = len(l.recent)
+	}
+	entries := make([]Entry, limit)
+	for i := 0; i < limit; i++ {
+		entries[i] = l.recent[len(l.recent)-1-i]
+	}
+	return entries
+}
+
+func (l *Log) remember(entry Entry) {
+	l.sequence = entry.Sequence
+	l.lastHash = entry.Hash
+	l.recent = append(l.recent, entry)
+	if len(l.recent) > l.size {
+		l.recent = l.recent[len(l.recent)-l.size:]
+	}
+}
+
+// Check the hash chain of the log at path. The error names the first entry that does not match.
+func Verify(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lastHash string
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry Entry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		if entry.PrevHash != lastHash {
+			return fmt.Errorf("line %d: chain broken before sequence %d", line, entry.Sequence)
+		}
+
+		recorded := entry.Hash
+		entry.Hash = ""
+		hash, err := entryHash(entry)
+		if err != nil {
+			return err
+		}
+		if hash != recorded {
+			return fmt.Errorf("line %d: sequence %d has been modified", line, entry.Sequence)
+		}
+		lastHash = recorded
+	}
+	return scanner.Err()
+}
+
+func entryHash(entry Entry) (string, error) {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
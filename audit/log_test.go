@@ -0,0 +1,190 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func tempLog(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path.Join(dir, "audit.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func TestLog_RecordAndReopen(t *testing.T) {
+	file, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"Connect", "SetPower", "SetTriggerArm"} {
+		err = l.Record(Entry{Operation: op, Result: "ok"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = l.Close()
+
+	l, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Record(Entry{Operation: "Disconnect", Result: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+
+	recent := l.Recent(2)
+	if len(recent) != 2 || recent[0].Operation != "Disconnect" || recent[0].Sequence != 4 {
+		t.Fatalf("Unexpected recent entries: %+v", recent)
+	}
+
+	err = Verify(file)
+	if err != nil {
+		t.Fatalf("Untouched log should verify: %s", err)
+	}
+}
+
+func TestVerify_DetectsTampering(t *testing.T) {
+	file, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Record(Entry{Operation: "SetPower", New: []byte(`{"MasterPower":false}`), Result: "ok"})
+	_ = l.Record(Entry{Operation: "SetTriggerArm", Result: "ok"})
+	_ = l.Close()
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = bytes.Replace(content, []byte(`"MasterPower":false`), []byte(`"MasterPower":true`), 1)
+	err = ioutil.WriteFile(file, content, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Verify(file) == nil {
+		t.Fatal("Modified entry should fail verification")
+	}
+}
+
+// A crash can leave the last line cut short or blank lines behind. Open carries on and records what it removed.
+func TestLog_OpenAfterCrash(t *testing.T) {
+	file, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Record(Entry{Operation: "SetPower", Result: "ok"})
+	_ = l.Record(Entry{Operation: "SetTriggerArm", Result: "ok"})
+	_ = l.Close()
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("\n\n{\"seq\":3,\"time\":\"2020-"))
+	_ = f.Close()
+
+	l, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Record(Entry{Operation: "Disconnect", Result: "ok"})
+	_ = l.Close()
+
+	recent := l.Recent(0)
+	if len(recent) != 4 || recent[1].Operation != "RecoverAuditLog" || recent[1].Sequence != 3 {
+		t.Fatalf("Expected the recovery recorded after the intact entries but got %+v", recent)
+	}
+	if !bytes.Contains(recent[1].Old, []byte(`2020-`)) {
+		t.Fatalf("Recovery entry does not hold the torn line: %s", recent[1].Old)
+	}
+	err = Verify(file)
+	if err != nil {
+		t.Fatalf("Recovered log should verify: %s", err)
+	}
+}
+
+// Only the tail of a long log is read back, and the chain continues from its last entry.
+func TestLog_OpenLongLog(t *testing.T) {
+	file, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := DefaultRecentSize + DefaultRecentSize/2
+	for i := 0; i < count; i++ {
+		err = l.Record(Entry{Operation: "SetPulseParam", New: []byte(`{"ExposureTick":{"Value":700}}`), Result: "ok"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = l.Close()
+
+	l, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent := l.Recent(0)
+	if len(recent) != DefaultRecentSize || recent[0].Sequence != uint64(count) ||
+		recent[len(recent)-1].Sequence != uint64(count-DefaultRecentSize+1) {
+		t.Fatalf("Unexpected entries read back: %d, newest %d", len(recent), recent[0].Sequence)
+	}
+	_ = l.Record(Entry{Operation: "Disconnect", Result: "ok"})
+	_ = l.Close()
+	err = Verify(file)
+	if err != nil {
+		t.Fatalf("Continued log should verify: %s", err)
+	}
+}
+
+func TestLog_OpenWithoutFinalNewline(t *testing.T) {
+	file, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Record(Entry{Operation: "SetPower", Result: "ok"})
+	_ = l.Close()
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(file, bytes.TrimRight(content, "\n"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Record(Entry{Operation: "Disconnect", Result: "ok"})
+	_ = l.Close()
+	if recent := l.Recent(0); len(recent) != 2 || recent[0].Sequence != 2 {
+		t.Fatalf("Unexpected entries: %+v", recent)
+	}
+	err = Verify(file)
+	if err != nil {
+		t.Fatalf("Log should verify: %s", err)
+	}
+}
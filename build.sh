@@ -2,3 +2,4 @@
 go get -d ./...
 go build . 
 go install .
+go install ./cmd/mvpulsectl
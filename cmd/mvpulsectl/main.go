@@ -0,0 +1,733 @@
+// Command mvpulsectl controls a running mvcamctrl daemon from the command line.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: mvpulsectl [flags] <command> [arguments]
+
+Commands:
+  devices [--probe] [--probe-timeout d]    list serial devices; --probe finds the pulse controllers (operator)
+  connect --name <by-id name> | --path <p> open a device
+  disconnect                               close the device
+  opened                                   show the opened device
+  version                                  show driver and device versions
+  power [on [--expect-revision n]|off]     show or switch the master power
+  params get                               read the pulse parameters from the device
+  params set [--exposure n] [--delay n] [--filter n] [--polarity normal|inverted] [--commit]
+             [--expect-revision n]         set the pulse parameters; fails if they changed after revision n
+  commit                                   commit the pulse parameters
+  arm | disarm                             arm or cancel the trigger
+  trigger                                  show whether the trigger is armed
+  reset                                    reset the device and close it
+  audit [--limit n]                        show recent audit log entries
+  history [--since t] [--until t] [--type a,b] [--limit n]
+                                           show device events; t is RFC 3339 or a duration ago such as 2h
+  loglevel [[module] level]                show or change the server log levels, admin only
+  lease acquire [--ttl d] [--force] [--owner s]
+                                           take exclusive control and print the lease ID; --force takes it over, admin only
+  lease renew <id> [--ttl d]               extend a lease
+  lease release <id>                       give up a lease
+  watch                                    follow state changes
+  raw <opcode> [bytes...] [:<length>]      send a raw opcode (hex) and print the reply, admin only
+  console                                  interactive raw opcode console, admin only
+
+Flags:
+`
+
+type client struct {
+	mvpulse.MicroVisionPulseServiceClient
+	conn    *grpc.ClientConn
+	token   string
+	lease   string
+	timeout time.Duration
+	json    bool
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	address := flag.String("addr", envOr("MVPULSE_ADDR", "localhost:3050"), "server address, host:port or unix:///path (env MVPULSE_ADDR)")
+	token := flag.String("token", os.Getenv("MVPULSE_TOKEN"), "bearer token (env MVPULSE_TOKEN)")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	caFile := flag.String("ca", "", "CA bundle (PEM) to verify the server with, implies -tls")
+	certFile := flag.String("cert", "", "client certificate (PEM) for mutual TLS, implies -tls")
+	keyFile := flag.String("key", "", "client private key (PEM)")
+	lease := flag.String("lease", os.Getenv("MVPULSE_LEASE"), "lease ID sent with every call (env MVPULSE_LEASE)")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of each call")
+	jsonOutput := flag.Bool("json", false, "print responses as JSON")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dialOption := grpc.WithInsecure()
+	if *useTLS || *caFile != "" || *certFile != "" {
+		creds, err := clientCredentials(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fail(err)
+		}
+		dialOption = grpc.WithTransportCredentials(creds)
+	}
+
+	conn, err := grpc.Dial(*address, dialOption)
+	if err != nil {
+		fail(err)
+	}
+	defer conn.Close()
+
+	c := &client{
+		MicroVisionPulseServiceClient: mvpulse.NewMicroVisionPulseServiceClient(conn),
+		conn:                          conn,
+		token:                         *token,
+		lease:                         *lease,
+		timeout:                       *timeout,
+		json:                          *jsonOutput,
+	}
+
+	err = c.run(flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		fail(err)
+	}
+}
+
+func (c *client) run(command string, args []string) error {
+	switch command {
+	case "devices":
+		return c.devices(args)
+	case "connect":
+		return c.connect(args)
+	case "disconnect":
+		return c.call(func(ctx context.Context) (proto.Message, error) {
+			return c.Disconnect(ctx, &mvpulse.DisconnectReq{})
+		})
+	case "opened":
+		return c.opened()
+	case "version":
+		return c.version()
+	case "power":
+		return c.power(args)
+	case "params":
+		return c.params(args)
+	case "commit":
+		return c.call(func(ctx context.Context) (proto.Message, error) {
+			return c.CommitParameter(ctx, &mvpulse.CommitParameterReq{})
+		})
+	case "arm", "disarm":
+		return c.call(func(ctx context.Context) (proto.Message, error) {
+			return c.SetTriggerArm(ctx, &mvpulse.SetTriggerArmReq{ArmTrigger: command == "arm"})
+		})
+	case "trigger":
+		return c.trigger()
+	case "reset":
+		return c.call(func(ctx context.Context) (proto.Message, error) {
+			return c.Reset(ctx, &mvpulse.ResetReq{})
+		})
+	case "audit":
+		return c.audit(args)
+	case "history":
+		return c.history(args)
+	case "loglevel":
+		return c.logLevel(args)
+	case "lease":
+		return c.leaseCommand(args)
+	case "watch":
+		return c.watch()
+	case "raw":
+		return c.raw(args)
+	case "console":
+		return c.console()
+	default:
+		flag.Usage()
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func (c *client) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.outgoing(), c.timeout)
+}
+
+// Context carrying the token and the lease ID, without deadline.
+func (c *client) outgoing() context.Context {
+	ctx := context.Background()
+	if c.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+	}
+	if c.lease != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-lease-id", c.lease)
+	}
+	return ctx
+}
+
+// Run a call that has nothing to report except success. The response is printed in JSON mode.
+func (c *client) call(f func(ctx context.Context) (proto.Message, error)) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := f(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(resp)
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func (c *client) printJSON(message proto.Message) error {
+	marshaler := jsonpb.Marshaler{EmitDefaults: true}
+	text, err := marshaler.MarshalToString(message)
+	if err != nil {
+		return err
+	}
+	fmt.Println(text)
+	return nil
+}
+
+func (c *client) devices(args []string) error {
+	flags := flag.NewFlagSet("devices", flag.ExitOnError)
+	probe := flags.Bool("probe", false, "ask every port for its version to find the pulse controllers")
+	probeTimeout := flags.Duration("probe-timeout", 0, "how long each port has to answer (server default when 0)")
+	_ = flags.Parse(args)
+
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := c.GetDevices(ctx, &mvpulse.GetDevicesReq{
+		Probe:          *probe,
+		ProbeTimeoutMs: uint32(*probeTimeout / time.Millisecond),
+	})
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(resp)
+	}
+	for _, device := range resp.Devices {
+		line := device.Name + "\t" + device.Path
+		if device.VendorId != "" {
+			line += fmt.Sprintf("\t%s:%s %q serial %q at usb %s", device.VendorId, device.ProductId,
+				strings.TrimSpace(device.Manufacturer+" "+device.Product), device.SerialNumber, device.UsbPath)
+		}
+		if device.Opened {
+			line += "\topened"
+		}
+		switch {
+		case device.PulseController:
+			line += fmt.Sprintf("\tpulse controller, hardware %d, firmware %d", device.HardwareVersion, device.FirmwareVersion)
+		case device.Probed:
+			line += "\tnot a pulse controller: " + device.ProbeError
+		case device.ProbeError != "":
+			line += "\tnot probed: " + device.ProbeError
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func (c *client) connect(args []string) error {
+	flags := flag.NewFlagSet("connect", flag.ExitOnError)
+	name := flags.String("name", "", "/dev/serial/by-id name of the device")
+	path := flags.String("path", "", "path of the device")
+	_ = flags.Parse(args)
+
+	req := &mvpulse.ConnectReq{}
+	switch {
+	case *name != "" && *path == "":
+		req.DeviceIdentifier = &mvpulse.ConnectReq_Name{Name: *name}
+	case *path != "" && *name == "":
+		req.DeviceIdentifier = &mvpulse.ConnectReq_Path{Path: *path}
+	default:
+		return errors.New("connect needs exactly one of --name or --path")
+	}
+
+	return c.call(func(ctx context.Context) (proto.Message, error) {
+		return c.Connect(ctx, req)
+	})
+}
+
+func (c *client) opened() error {
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := c.Opened(ctx, &mvpulse.OpenedReq{})
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(resp)
+	}
+	if !resp.Opened {
+		fmt.Println("not opened")
+		return nil
+	}
+	fmt.Printf("%s\t%s", resp.OpenedDevice.Name, resp.OpenedDevice.Path)
+	if resp.NotResponding {
+		fmt.Print("\tnot responding")
+	}
+	if resp.Lease != nil {
+		fmt.Printf("\tleased by %s until %s", resp.Lease.Holder, leaseExpiry(resp.Lease))
+	}
+	fmt.Println()
+	return nil
+}
+
+func (c *client) version() error {
+	ctx, cancel := c.context()
+	defer cancel()
+	driver, err := c.DriverVersion(ctx, &mvpulse.DriverVersionReq{})
+	if err != nil {
+		return err
+	}
+	device, err := c.DeviceVersion(ctx, &mvpulse.DeviceVersionReq{})
+	if err != nil {
+		return err
+	}
+	if c.json {
+		fmt.Printf(`{"driverVersion":%q,"hardwareVersion":%d,"firmwareVersion":%d}`+"\n",
+			driver.Version, device.HardwareVersion, device.FirmwareVersion)
+		return nil
+	}
+	fmt.Printf("driver %s, hardware %d, firmware %d\n", driver.Version, device.HardwareVersion, device.FirmwareVersion)
+	return nil
+}
+
+func (c *client) power(args []string) error {
+	if len(args) == 0 {
+		ctx, cancel := c.context()
+		defer cancel()
+		resp, err := c.GetPower(ctx, &mvpulse.GetPowerReq{})
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(resp)
+		}
+		fmt.Println(onOff(resp.Power.MasterPower))
+		return nil
+	}
+
+	var on bool
+	switch args[0] {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		return fmt.Errorf("power expects on or off, got %q", args[0])
+	}
+	flags := flag.NewFlagSet("power", flag.ExitOnError)
+	expected := flags.Int64("expect-revision", -1, "fail if the power changed after this state revision")
+	_ = flags.Parse(args[1:])
+
+	req := &mvpulse.SetPowerReq{
+		Power:            &mvpulse.PowerConfiguration{MasterPower: on},
+		ExpectedRevision: expectedRevision(*expected),
+	}
+	return c.call(func(ctx context.Context) (proto.Message, error) {
+		return c.SetPower(ctx, req)
+	})
+}
+
+func (c *client) params(args []string) error {
+	if len(args) == 0 {
+		return errors.New("params expects get or set")
+	}
+
+	switch args[0] {
+	case "get":
+		ctx, cancel := c.context()
+		defer cancel()
+		resp, err := c.GetPulseParam(ctx, &mvpulse.GetPulseParamReq{})
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(resp)
+		}
+		printPulse(resp.Pulse)
+		return nil
+	case "set":
+		return c.setParams(args[1:])
+	default:
+		return fmt.Errorf("params expects get or set, got %q", args[0])
+	}
+}
+
+func (c *client) setParams(args []string) error {
+	flags := flag.NewFlagSet("params set", flag.ExitOnError)
+	exposure := flags.Int64("exposure", -1, "exposure in ticks")
+	delay := flags.Int64("delay", -1, "pulse delay in ticks")
+	filter := flags.Int64("filter", -1, "digital filter length")
+	polarity := flags.String("polarity", "", "normal or inverted")
+	commit := flags.Bool("commit", false, "commit the parameters after setting them")
+	expected := flags.Int64("expect-revision", -1, "fail if the parameters changed after this state revision")
+	_ = flags.Parse(args)
+
+	pulse := &mvpulse.PulseConfiguration{}
+	if *exposure >= 0 {
+		pulse.ExposureTick = &wrappers.UInt32Value{Value: uint32(*exposure)}
+	}
+	if *delay >= 0 {
+		pulse.PulseDelay = &wrappers.UInt32Value{Value: uint32(*delay)}
+	}
+	if *filter >= 0 {
+		pulse.DigitalFilter = &wrappers.UInt32Value{Value: uint32(*filter)}
+	}
+	switch *polarity {
+	case "":
+	case "normal":
+		pulse.Polarity = &wrappers.BoolValue{Value: false}
+	case "inverted":
+		pulse.Polarity = &wrappers.BoolValue{Value: true}
+	default:
+		return fmt.Errorf("polarity expects normal or inverted, got %q", *polarity)
+	}
+
+	return c.call(func(ctx context.Context) (proto.Message, error) {
+		return c.SetPulseParam(ctx, &mvpulse.SetPulseParamReq{
+			Pulse:            pulse,
+			Commit:           *commit,
+			ExpectedRevision: expectedRevision(*expected),
+		})
+	})
+}
+
+// Negative means no expected revision.
+func expectedRevision(revision int64) *wrappers.UInt64Value {
+	if revision < 0 {
+		return nil
+	}
+	return &wrappers.UInt64Value{Value: uint64(revision)}
+}
+
+func (c *client) trigger() error {
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := c.GetTriggerArm(ctx, &mvpulse.GetTriggerArmReq{})
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(resp)
+	}
+	if resp.ArmTrigger {
+		fmt.Println("armed")
+	} else {
+		fmt.Println("disarmed")
+	}
+	return nil
+}
+
+func (c *client) audit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	limit := flags.Uint("limit", 20, "number of entries")
+	_ = flags.Parse(args)
+
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := c.GetAuditLog(ctx, &mvpulse.GetAuditLogReq{Limit: uint32(*limit)})
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(resp)
+	}
+	for _, entry := range resp.Entries {
+		who := entry.Identity
+		if who == "" {
+			who = entry.Peer
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s -> %s\t%s\n", entry.Sequence, time.Unix(entry.Time.Seconds, 0).Format(time.RFC3339),
+			who, entry.Operation, entry.OldValue, entry.NewValue, entry.Result)
+	}
+	return nil
+}
+
+func (c *client) history(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	since := flags.String("since", "", "oldest event, RFC 3339 time or a duration ago")
+	until := flags.String("until", "", "newest event, RFC 3339 time or a duration ago")
+	types := flags.String("type", "", "comma separated event types such as power,timeout")
+	limit := flags.Uint("limit", 50, "number of events, newest kept")
+	_ = flags.Parse(args)
+
+	req := &mvpulse.GetHistoryReq{Limit: uint32(*limit)}
+	var err error
+	if *since != "" {
+		req.Since, err = parseTime(*since)
+		if err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		req.Until, err = parseTime(*until)
+		if err != nil {
+			return err
+		}
+	}
+	if *types != "" {
+		req.Types = strings.Split(*types, ",")
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := c.GetHistory(ctx, req)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(resp)
+	}
+	for _, event := range resp.Events {
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\n", event.Sequence, time.Unix(event.Time.Seconds, 0).Format(time.RFC3339),
+			event.Type, event.Device, event.Message)
+	}
+	return nil
+}
+
+func (c *client) logLevel(args []string) error {
+	req := &mvpulse.SetLogLevelReq{}
+	switch len(args) {
+	case 0:
+	case 1:
+		req.Level = args[0]
+	case 2:
+		req.Module, req.Level = args[0], args[1]
+	default:
+		return errors.New("usage: loglevel [[module] level]")
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := c.SetLogLevel(ctx, req)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(resp)
+	}
+	modules := make([]string, 0, len(resp.Levels))
+	for module := range resp.Levels {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+	for _, module := range modules {
+		name := module
+		if name == "" {
+			name = "(default)"
+		}
+		fmt.Printf("%-12s%s\n", name, resp.Levels[module])
+	}
+	return nil
+}
+
+func (c *client) leaseCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: lease acquire|renew|release")
+	}
+	switch args[0] {
+	case "acquire":
+		flags := flag.NewFlagSet("lease acquire", flag.ExitOnError)
+		ttl := flags.Duration("ttl", 0, "lease duration (server default when 0)")
+		force := flags.Bool("force", false, "take the lease over from its holder, admin only")
+		owner := flags.String("owner", "", "name shown to other clients")
+		_ = flags.Parse(args[1:])
+		return c.printLease(func(ctx context.Context) (*mvpulse.LeaseRes, error) {
+			return c.AcquireLease(ctx, &mvpulse.AcquireLeaseReq{
+				TtlMs: uint32(*ttl / time.Millisecond),
+				Force: *force,
+				Owner: *owner,
+			})
+		})
+	case "renew":
+		flags := flag.NewFlagSet("lease renew", flag.ExitOnError)
+		ttl := flags.Duration("ttl", 0, "lease duration (server default when 0)")
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return errors.New("usage: lease renew <id> [--ttl d]")
+		}
+		return c.printLease(func(ctx context.Context) (*mvpulse.LeaseRes, error) {
+			return c.RenewLease(ctx, &mvpulse.RenewLeaseReq{
+				LeaseId: flags.Arg(0),
+				TtlMs:   uint32(*ttl / time.Millisecond),
+			})
+		})
+	case "release":
+		if len(args) != 2 {
+			return errors.New("usage: lease release <id>")
+		}
+		return c.call(func(ctx context.Context) (proto.Message, error) {
+			return c.ReleaseLease(ctx, &mvpulse.ReleaseLeaseReq{LeaseId: args[1]})
+		})
+	default:
+		return fmt.Errorf("unknown lease command %q", args[0])
+	}
+}
+
+func (c *client) printLease(f func(ctx context.Context) (*mvpulse.LeaseRes, error)) error {
+	ctx, cancel := c.context()
+	defer cancel()
+	resp, err := f(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(resp)
+	}
+	fmt.Printf("%s\texpires %s\n", resp.Lease.Id, leaseExpiry(resp.Lease))
+	return nil
+}
+
+func leaseExpiry(lease *mvpulse.Lease) string {
+	if lease.Expires == nil {
+		return "never"
+	}
+	return time.Unix(lease.Expires.Seconds, 0).Format(time.RFC3339)
+}
+
+// Accept an RFC 3339 time or a duration before now.
+func parseTime(text string) (*timestamp.Timestamp, error) {
+	t, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		ago, durationErr := time.ParseDuration(text)
+		if durationErr != nil {
+			return nil, fmt.Errorf("invalid time %q: use RFC 3339 or a duration such as 2h", text)
+		}
+		t = time.Now().Add(-ago)
+	}
+	return ptypes.TimestampProto(t)
+}
+
+// Follow ParameterStreaming until interrupted. The stream has no deadline.
+func (c *client) watch() error {
+	stream, err := c.ParameterStreaming(c.outgoing())
+	if err != nil {
+		return err
+	}
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c.json {
+			err = c.printJSON(message)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%s rev=%d opened=%t power=%s armed=%t", time.Now().Format("15:04:05"), message.Revision,
+			message.Opened, powerText(message.Power), message.TriggerArmed)
+		if message.NotResponding {
+			fmt.Print(" not-responding")
+		}
+		if message.PowerOffReason != "" {
+			fmt.Printf(" power-off-reason=%q", message.PowerOffReason)
+		}
+		if message.Lease != nil {
+			fmt.Printf(" lease=%q", message.Lease.Holder)
+		}
+		fmt.Println()
+		if message.Pulse != nil {
+			printPulse(message.Pulse)
+		}
+	}
+}
+
+func printPulse(pulse *mvpulse.PulseConfiguration) {
+	if pulse == nil {
+		return
+	}
+	if pulse.ExposureTick != nil {
+		fmt.Printf("exposure\t%d\n", pulse.ExposureTick.Value)
+	}
+	if pulse.PulseDelay != nil {
+		fmt.Printf("delay\t%d\n", pulse.PulseDelay.Value)
+	}
+	if pulse.DigitalFilter != nil {
+		fmt.Printf("filter\t%d\n", pulse.DigitalFilter.Value)
+	}
+	if pulse.Polarity != nil {
+		if pulse.Polarity.Value {
+			fmt.Println("polarity\tinverted")
+		} else {
+			fmt.Println("polarity\tnormal")
+		}
+	}
+}
+
+func powerText(power *mvpulse.PowerConfiguration) string {
+	if power == nil {
+		return "unknown"
+	}
+	return onOff(power.MasterPower)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func clientCredentials(caFile, certFile, keyFile string) (credentials.TransportCredentials, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, strings.TrimSpace(err.Error()))
+	os.Exit(1)
+}
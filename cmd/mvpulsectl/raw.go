@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const consoleHelp = `Enter one command per line, all numbers in hex:
+  <opcode> [argument bytes...] [:<response length>]
+Examples:
+  20 :2        version, expect 2 bytes
+  30 01        power on
+  44 e8 03     exposure 1000 ticks
+Type "help" for this text and "quit" or Ctrl-D to leave.
+`
+
+// Parse "<opcode> [argument bytes...] [:<response length>]" with every number in hex.
+func parseRawCommand(fields []string) (*mvpulse.RawCommandReq, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("missing opcode")
+	}
+
+	req := &mvpulse.RawCommandReq{}
+	for i, field := range fields {
+		field = strings.TrimPrefix(strings.ToLower(field), "0x")
+		if strings.HasPrefix(field, ":") {
+			if i != len(fields)-1 {
+				return nil, errors.New("the response length must come last")
+			}
+			length, err := strconv.ParseUint(strings.TrimPrefix(field, ":"), 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid response length %q", field)
+			}
+			req.ResponseLength = uint32(length)
+			continue
+		}
+
+		value, err := strconv.ParseUint(field, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid byte %q", field)
+		}
+		if i == 0 {
+			req.Opcode = uint32(value)
+		} else {
+			req.Argument = append(req.Argument, byte(value))
+		}
+	}
+	return req, nil
+}
+
+func (c *client) rawCommand(req *mvpulse.RawCommandReq) ([]byte, error) {
+	ctx, cancel := c.context()
+	defer cancel()
+	req.TimeoutMs = uint32(c.timeout / time.Millisecond)
+	resp, err := c.RawCommand(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Response, nil
+}
+
+func (c *client) raw(args []string) error {
+	req, err := parseRawCommand(args)
+	if err != nil {
+		return err
+	}
+	response, err := c.rawCommand(req)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		fmt.Printf(`{"response":%q}`+"\n", hex.EncodeToString(response))
+		return nil
+	}
+	fmt.Printf("% x\n", response)
+	return nil
+}
+
+// Interactive hex console for bringing up firmware. Errors are printed and the console keeps going.
+func (c *client) console() error {
+	fmt.Print(consoleHelp)
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "quit", "exit":
+			return nil
+		case "help", "?":
+			fmt.Print(consoleHelp)
+			continue
+		}
+
+		req, err := parseRawCommand(fields)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			continue
+		}
+		start := time.Now()
+		response, err := c.rawCommand(req)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			continue
+		}
+		fmt.Printf("< % x (%s)\n", response, time.Since(start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseRawCommand(t *testing.T) {
+	req, err := parseRawCommand([]string{"0x44", "e8", "03", ":0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Opcode != 0x44 || !bytes.Equal(req.Argument, []byte{0xe8, 0x03}) || req.ResponseLength != 0 {
+		t.Fatalf("Unexpected request: %+v", req)
+	}
+
+	req, err = parseRawCommand([]string{"20", ":2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Opcode != 0x20 || len(req.Argument) != 0 || req.ResponseLength != 2 {
+		t.Fatalf("Unexpected request: %+v", req)
+	}
+
+	for _, fields := range [][]string{{}, {"100"}, {"20", ":2", "01"}, {"zz"}} {
+		if _, err := parseRawCommand(fields); err == nil {
+			t.Errorf("Expected %v to be rejected", fields)
+		}
+	}
+}
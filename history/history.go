@@ -0,0 +1,274 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DefaultSize = 10000
+
+// Event types.
+const (
+	Connect    = "connect"
+	Disconnect = "disconnect"
+	Power      = "power"
+	Parameter  = "parameter"
+	Trigger    = "trigger"
+	SafeOff    = "safe_off"
+	Timeout    = "timeout"
+	Resync     = "resync"
+	Watchdog   = "watchdog"
+	Lease      = "lease"
+	Error      = "error"
+)
+
+// One state transition or device event.
+type Event struct {
+	Sequence uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Device   string    `json:"device,omitempty"`
+	Message  string    `json:"message"`
+	// State revision after the event, if it changed the state.
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// Selects events in Query. Zero fields do not filter.
+type Filter struct {
+	Since time.Time
+	Until time.Time
+	Types []string
+	// Keep only the newest matching events.
+	Limit int
+}
+
+func (f Filter) matches(event Event) bool {
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && event.Time.After(f.Until) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// History keeps the most recent events in a ring buffer. With a file the events are also appended as JSON lines and
+// read back on the next start. The file is compacted to the buffer contents when it grows to twice the buffer size.
+type History struct {
+	mutex    sync.Mutex
+	events   []Event
+	next     int
+	full     bool
+	sequence uint64
+
+	path      string
+	file      *os.File
+	fileLines int
+}
+
+func New(size int) *History {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &History{
+		events: make([]Event, size),
+	}
+}
+
+// Open the history at path, creating it if needed. An empty path keeps the history in memory only.
+func Open(path string, size int) (*History, error) {
+	h := New(size)
+	if path == "" {
+		return h, nil
+	}
+	h.path = path
+
+	unterminated := false
+	existing, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event Event
+			err = json.Unmarshal(scanner.Bytes(), &event)
+			if err != nil {
+				// a line cut short by a crash is not worth refusing to start
+				continue
+			}
+			h.remember(event)
+			h.fileLines++
+		}
+		err = scanner.Err()
+		if err == nil {
+			unterminated, err = endsUnterminated(existing)
+		}
+		_ = existing.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	h.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if unterminated {
+		// end the torn line, so that the next event starts a line of its own
+		_, err = h.file.Write([]byte{'\n'})
+		if err != nil {
+			_ = h.file.Close()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Whether the file does not end with a newline, as after a crash in the middle of a write.
+func endsUnterminated(f *os.File) (bool, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	_, err = f.ReadAt(last, info.Size()-1)
+	if err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+func (h *History) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// Add the event. Sequence and time are filled in by the history.
+func (h *History) Record(event Event) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	event.Sequence = h.sequence + 1
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	h.remember(event)
+
+	if h.file == nil {
+		return nil
+	}
+	if h.fileLines >= 2*len(h.events) {
+		err := h.compact()
+		if err != nil {
+			return err
+		}
+		// the compacted file already holds the event
+		return nil
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = h.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	h.fileLines++
+	return nil
+}
+
+// Matching events, oldest first.
+func (h *History) Query(filter Filter) []Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var events []Event
+	for _, event := range h.ordered() {
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+	}
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+	return events
+}
+
+func (h *History) remember(event Event) {
+	h.sequence = event.Sequence
+	h.events[h.next] = event
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+func (h *History) ordered() []Event {
+	if !h.full {
+		return append([]Event(nil), h.events[:h.next]...)
+	}
+	return append(append([]Event(nil), h.events[h.next:]...), h.events[:h.next]...)
+}
+
+// Rewrite the file with the events in the buffer and continue appending to it.
+func (h *History) compact() error {
+	temp, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(temp)
+	events := h.ordered()
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			_ = temp.Close()
+			_ = os.Remove(temp.Name())
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = temp.Close()
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		return err
+	}
+
+	err = os.Rename(temp.Name(), h.path)
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		return fmt.Errorf("failed to replace %s: %s", h.path, err.Error())
+	}
+	_ = h.file.Close()
+	h.file, err = os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	h.fileLines = len(events)
+	return nil
+}
@@ -0,0 +1,150 @@
+package history
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func tempHistory(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path.Join(dir, "history.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func countLines(t *testing.T, file string) int {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestHistory_RingBuffer(t *testing.T) {
+	h := New(3)
+	for _, message := range []string{"a", "b", "c", "d", "e"} {
+		err := h.Record(Event{Type: Power, Message: message})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := h.Query(Filter{})
+	if len(events) != 3 || events[0].Message != "c" || events[2].Message != "e" || events[2].Sequence != 5 {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+}
+
+func TestHistory_Filter(t *testing.T) {
+	h := New(10)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	types := []string{Connect, Power, Parameter, Power, Timeout, Disconnect}
+	for i, eventType := range types {
+		err := h.Record(Event{Time: start.Add(time.Duration(i) * time.Minute), Type: eventType})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := h.Query(Filter{Types: []string{Power, Timeout}})
+	if len(events) != 3 || events[0].Sequence != 2 || events[2].Type != Timeout {
+		t.Fatalf("Unexpected events by type: %+v", events)
+	}
+
+	events = h.Query(Filter{Since: start.Add(2 * time.Minute), Until: start.Add(4 * time.Minute)})
+	if len(events) != 3 || events[0].Type != Parameter || events[2].Type != Timeout {
+		t.Fatalf("Unexpected events by time: %+v", events)
+	}
+
+	events = h.Query(Filter{Types: []string{Power}, Limit: 1})
+	if len(events) != 1 || events[0].Sequence != 4 {
+		t.Fatalf("Unexpected limited events: %+v", events)
+	}
+}
+
+func TestHistory_Persistence(t *testing.T) {
+	file, cleanup := tempHistory(t)
+	defer cleanup()
+
+	h, err := Open(file, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		err = h.Record(Event{Type: Parameter})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = h.Close()
+
+	// compacted whenever the file reaches twice the buffer size
+	if lines := countLines(t, file); lines > 8 {
+		t.Fatalf("Expected the file to be compacted but it has %d lines", lines)
+	}
+
+	h, err = Open(file, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	err = h.Record(Event{Type: Disconnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.Query(Filter{})
+	if len(events) != 4 || events[0].Sequence != 18 || events[3].Sequence != 21 || events[3].Type != Disconnect {
+		t.Fatalf("Unexpected events after reopening: %+v", events)
+	}
+}
+
+// The first event after a crash that tore the last line survives the next restart.
+func TestHistory_TornLine(t *testing.T) {
+	file, cleanup := tempHistory(t)
+	defer cleanup()
+
+	h, err := Open(file, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = h.Record(Event{Type: Connect})
+	_ = h.Close()
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte(`{"seq":2,"ty`))
+	_ = f.Close()
+
+	h, err = Open(file, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.Record(Event{Type: Power})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = h.Close()
+
+	h, err = Open(file, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	events := h.Query(Filter{})
+	if len(events) != 2 || events[1].Type != Power || events[1].Sequence != 2 {
+		t.Fatalf("Event recorded after the torn line was lost: %+v", events)
+	}
+}
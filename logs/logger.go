@@ -0,0 +1,142 @@
+package logs
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	"sort"
+	"strings"
+)
+
+// Field names used across the daemon.
+const (
+	FieldDevice    = "device"
+	FieldOpcode    = "opcode"
+	FieldRequestID = "request_id"
+	FieldPeer      = "peer"
+	FieldIdentity  = "identity"
+	FieldTraceID   = "trace_id"
+)
+
+type Fields map[string]interface{}
+
+// Logger is a go-logging logger that attaches fields to its messages. In text output the fields follow the message
+// as key=value pairs; in JSON output they are separate keys.
+type Logger struct {
+	*logging.Logger
+	fields Fields
+}
+
+// New returns the logger of a module. The module name is what the per-module levels refer to.
+func New(module string) *Logger {
+	modulesMutex.Lock()
+	modules[module] = true
+	modulesMutex.Unlock()
+
+	logger := logging.MustGetLogger(module)
+	logger.ExtraCalldepth = 1
+	return &Logger{Logger: logger}
+}
+
+// With returns a logger that adds the key and value pairs to every message. Empty values are left out.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := Fields{}
+	for key, value := range l.fields {
+		fields[key] = value
+	}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		value := keysAndValues[i+1]
+		if value == nil || value == "" {
+			continue
+		}
+		fields[key] = value
+	}
+	return &Logger{Logger: l.Logger, fields: fields}
+}
+
+func (l *Logger) wrap(format string, args []interface{}) (string, []interface{}) {
+	if len(l.fields) == 0 {
+		return format, args
+	}
+	return "%s", []interface{}{entry{message: fmt.Sprintf(format, args...), fields: l.fields}}
+}
+
+func (l *Logger) Criticalf(format string, args ...interface{}) {
+	if l.IsEnabledFor(logging.CRITICAL) {
+		format, args = l.wrap(format, args)
+		l.Logger.Criticalf(format, args...)
+	}
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	if l.IsEnabledFor(logging.ERROR) {
+		format, args = l.wrap(format, args)
+		l.Logger.Errorf(format, args...)
+	}
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	if l.IsEnabledFor(logging.WARNING) {
+		format, args = l.wrap(format, args)
+		l.Logger.Warningf(format, args...)
+	}
+}
+
+func (l *Logger) Noticef(format string, args ...interface{}) {
+	if l.IsEnabledFor(logging.NOTICE) {
+		format, args = l.wrap(format, args)
+		l.Logger.Noticef(format, args...)
+	}
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	if l.IsEnabledFor(logging.INFO) {
+		format, args = l.wrap(format, args)
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if l.IsEnabledFor(logging.DEBUG) {
+		format, args = l.wrap(format, args)
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l *Logger) Error(args ...interface{}) {
+	l.Errorf("%s", fmt.Sprint(args...))
+}
+
+func (l *Logger) Warning(args ...interface{}) {
+	l.Warningf("%s", fmt.Sprint(args...))
+}
+
+func (l *Logger) Info(args ...interface{}) {
+	l.Infof("%s", fmt.Sprint(args...))
+}
+
+func (l *Logger) Debug(args ...interface{}) {
+	l.Debugf("%s", fmt.Sprint(args...))
+}
+
+// A message with fields, passed through go-logging as the only argument so that the JSON formatter can take the fields
+// apart again.
+type entry struct {
+	message string
+	fields  Fields
+}
+
+func (e entry) String() string {
+	keys := make([]string, 0, len(e.fields))
+	for key := range e.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(e.message)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, e.fields[key])
+	}
+	return b.String()
+}
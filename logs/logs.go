@@ -0,0 +1,221 @@
+// Package logs sets up the go-logging backend of the daemon: per-module levels that can be changed at runtime, text or
+// JSON output, optional file rotation, and loggers that carry structured fields.
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	textFormat = "%{time:2006-01-02T15:04:05.000Z07:00} %{level:.4s} [%{module}] %{message}"
+)
+
+type Config struct {
+	// Default level: debug, info, notice, warning, error or critical.
+	Level string `json:"level"`
+	// Level of individual modules such as "Serial" or "Pulse".
+	Modules map[string]string `json:"modules"`
+	// "text" (default) or "json", one object per line.
+	Format string `json:"format"`
+	// Write to this file instead of stderr. It is rotated when MaxSizeMB is set.
+	File       string `json:"file"`
+	MaxSizeMB  int    `json:"max_size_mb"`
+	MaxBackups int    `json:"max_backups"`
+	MaxAgeDays int    `json:"max_age_days"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Level:  "info",
+		Format: FormatText,
+	}
+}
+
+var (
+	backend = newLeveledBackend(logging.NewLogBackend(os.Stderr, "", 0))
+	output  io.Closer
+
+	modulesMutex sync.Mutex
+	modules      = map[string]bool{}
+)
+
+func init() {
+	logging.SetBackend(backend)
+}
+
+// Setup replaces the logging backend. It is meant to be called once at startup; levels can be changed later with
+// SetLevel.
+func Setup(config Config) error {
+	var writer io.Writer = os.Stderr
+	var closer io.Closer
+	if config.File != "" {
+		if config.MaxSizeMB > 0 {
+			rotating := &lumberjack.Logger{
+				Filename:   config.File,
+				MaxSize:    config.MaxSizeMB,
+				MaxBackups: config.MaxBackups,
+				MaxAge:     config.MaxAgeDays,
+			}
+			writer, closer = rotating, rotating
+		} else {
+			file, err := os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+			if err != nil {
+				return err
+			}
+			writer, closer = file, file
+		}
+	}
+
+	var formatter logging.Formatter
+	switch strings.ToLower(config.Format) {
+	case "", FormatText:
+		formatter = logging.MustStringFormatter(textFormat)
+	case FormatJSON:
+		formatter = jsonFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q", config.Format)
+	}
+
+	levels := map[string]logging.Level{}
+	if config.Level != "" {
+		level, err := logging.LogLevel(config.Level)
+		if err != nil {
+			return fmt.Errorf("invalid log level %q", config.Level)
+		}
+		levels[""] = level
+	}
+	for module, name := range config.Modules {
+		level, err := logging.LogLevel(name)
+		if err != nil {
+			return fmt.Errorf("invalid log level %q for %s", name, module)
+		}
+		levels[module] = level
+	}
+
+	backend.replace(logging.NewBackendFormatter(logging.NewLogBackend(writer, "", 0), formatter), levels)
+	logging.SetBackend(backend)
+	if output != nil {
+		_ = output.Close()
+	}
+	output = closer
+	return nil
+}
+
+// Set the level of module, or the default level when module is empty.
+func SetLevel(module string, name string) error {
+	level, err := logging.LogLevel(name)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q", name)
+	}
+	backend.SetLevel(level, module)
+	return nil
+}
+
+// Current level of the default ("") and of every known module.
+func Levels() map[string]string {
+	modulesMutex.Lock()
+	names := []string{""}
+	for module := range modules {
+		names = append(names, module)
+	}
+	modulesMutex.Unlock()
+	sort.Strings(names)
+
+	levels := map[string]string{}
+	for _, module := range names {
+		levels[module] = strings.ToLower(backend.GetLevel(module).String())
+	}
+	return levels
+}
+
+// Backend with per-module levels that may be changed while other goroutines log.
+type leveledBackend struct {
+	mutex   sync.RWMutex
+	backend logging.Backend
+	levels  map[string]logging.Level
+}
+
+func newLeveledBackend(b logging.Backend) *leveledBackend {
+	return &leveledBackend{
+		backend: logging.NewBackendFormatter(b, logging.MustStringFormatter(textFormat)),
+		levels:  map[string]logging.Level{"": logging.INFO},
+	}
+}
+
+func (b *leveledBackend) replace(backend logging.Backend, levels map[string]logging.Level) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.backend = backend
+	if _, ok := levels[""]; !ok {
+		levels[""] = logging.INFO
+	}
+	b.levels = levels
+}
+
+func (b *leveledBackend) GetLevel(module string) logging.Level {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	level, ok := b.levels[module]
+	if !ok {
+		level = b.levels[""]
+	}
+	return level
+}
+
+func (b *leveledBackend) SetLevel(level logging.Level, module string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.levels[module] = level
+}
+
+func (b *leveledBackend) IsEnabledFor(level logging.Level, module string) bool {
+	return level <= b.GetLevel(module)
+}
+
+func (b *leveledBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	if !b.IsEnabledFor(level, record.Module) {
+		return nil
+	}
+	b.mutex.RLock()
+	backend := b.backend
+	b.mutex.RUnlock()
+	return backend.Log(level, calldepth+1, record)
+}
+
+// JSON output: {"time": ..., "level": ..., "module": ..., "msg": ..., <fields>}.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(calldepth int, record *logging.Record, output io.Writer) error {
+	line := map[string]interface{}{}
+	message := record.Message()
+	if len(record.Args) == 1 {
+		if e, ok := record.Args[0].(entry); ok {
+			for key, value := range e.fields {
+				line[key] = value
+			}
+			message = e.message
+		}
+	}
+	line["time"] = record.Time.Format("2006-01-02T15:04:05.000Z07:00")
+	line["level"] = strings.ToLower(record.Level.String())
+	line["module"] = record.Module
+	line["msg"] = message
+
+	content, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(content)
+	return err
+}
@@ -0,0 +1,98 @@
+package logs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func setupTemp(t *testing.T, config Config) (string, func()) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.File = path.Join(dir, "daemon.log")
+	err = Setup(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.File, func() {
+		_ = Setup(DefaultConfig())
+		os.RemoveAll(dir)
+	}
+}
+
+func readLines(t *testing.T, file string) []string {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestLogger_JSONFields(t *testing.T) {
+	file, cleanup := setupTemp(t, Config{Level: "debug", Format: FormatJSON})
+	defer cleanup()
+
+	New("Test").With(FieldDevice, "usb-pulse", FieldOpcode, "set_power", FieldPeer, "").Warningf("No response after %d ms", 50)
+
+	lines := readLines(t, file)
+	var line map[string]interface{}
+	err := json.Unmarshal([]byte(lines[len(lines)-1]), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line["msg"] != "No response after 50 ms" || line["level"] != "warning" || line["module"] != "Test" ||
+		line[FieldDevice] != "usb-pulse" || line[FieldOpcode] != "set_power" {
+		t.Fatalf("Unexpected line: %v", line)
+	}
+	if _, ok := line[FieldPeer]; ok {
+		t.Fatal("Empty fields should be left out")
+	}
+}
+
+func TestLogger_TextFields(t *testing.T) {
+	file, cleanup := setupTemp(t, Config{Level: "info"})
+	defer cleanup()
+
+	New("Test").With(FieldRequestID, "7", FieldDevice, "usb-pulse").Infof("Connected")
+
+	lines := readLines(t, file)
+	if !strings.HasSuffix(lines[len(lines)-1], "[Test] Connected device=usb-pulse request_id=7") {
+		t.Fatalf("Unexpected line: %s", lines[len(lines)-1])
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	file, cleanup := setupTemp(t, Config{Level: "info", Modules: map[string]string{"Quiet": "error"}})
+	defer cleanup()
+
+	quiet := New("Quiet")
+	loud := New("Loud")
+	quiet.Infof("hidden")
+	loud.Debugf("hidden")
+	loud.Infof("shown 1")
+
+	err := SetLevel("Quiet", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet.Debugf("shown 2")
+
+	if SetLevel("Quiet", "verbose") == nil {
+		t.Fatal("Expected an invalid level to be rejected")
+	}
+
+	lines := readLines(t, file)
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "shown 1") || !strings.HasSuffix(lines[1], "shown 2") {
+		t.Fatalf("Unexpected lines: %q", lines)
+	}
+
+	levels := Levels()
+	if levels["Quiet"] != "debug" || levels["Loud"] != "info" || levels[""] != "info" {
+		t.Fatalf("Unexpected levels: %v", levels)
+	}
+}
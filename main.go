@@ -1,11 +1,180 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/wuyuanyi135/mvcamctrl/logs"
+	"github.com/wuyuanyi135/mvcamctrl/safety"
 	"github.com/wuyuanyi135/mvcamctrl/server"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
+var log = logs.New("Main")
+
+// Settings are applied in order: defaults, configuration file, environment, command-line flags.
 func main() {
-	fmt.Println("Starting server")
-	mvcamctrl.StartServer()
+	configFile := flag.String("config", os.Getenv("MVPULSE_CONFIG"), "JSON configuration file (env MVPULSE_CONFIG)")
+	listen := flag.String("listen", "", "comma separated listen addresses: host:port or unix:///path (env MVPULSE_LISTEN)")
+	httpListen := flag.String("http", "", "comma separated listen addresses of the HTTP/JSON gateway (env MVPULSE_HTTP)")
+	device := flag.String("device", "", "device to open at startup, by-id name or path (env MVPULSE_DEVICE)")
+	baudRate := flag.Int("baud", 0, "serial baud rate")
+	simulate := flag.Bool("simulate", false, "list and open virtual pulse controllers instead of the serial ports (env MVPULSE_SIMULATE)")
+	simulateCount := flag.Int("simulate-count", 1, "number of virtual pulse controllers with -simulate")
+	deadMan := flag.Duration("deadman", 0, "switch the laser off when no operator has been seen for this long (0, the default, disables)")
+	mqttBroker := flag.String("mqtt", "", "MQTT broker URL such as tcp://localhost:1883; enables the MQTT bridge (env MVPULSE_MQTT)")
+	auditLog := flag.String("audit", "", "append every state-changing operation to this JSON lines file")
+	historyFile := flag.String("history", "", "keep the device event history in this JSON lines file across restarts")
+	policyFile := flag.String("safety", "", "JSON file with the default and per-device safety limits")
+	logLevel := flag.String("log-level", "", "default log level: debug, info, notice, warning, error or critical (env MVPULSE_LOG_LEVEL)")
+	logFormat := flag.String("log-format", "", "log output format, text or json")
+	logFile := flag.String("log-file", "", "write the log to this file instead of stderr")
+	traceExporter := flag.String("trace", "", "export traces of the calls and serial transactions: otlp or stdout")
+	traceEndpoint := flag.String("trace-endpoint", "", "OTLP/gRPC collector such as http://localhost:4317 (default OTEL_EXPORTER_OTLP_ENDPOINT)")
+	authFile := flag.String("auth", "", "JSON file mapping tokens and client certificates to read/operator/admin roles")
+	tlsCert := flag.String("tls-cert", "", "server certificate (PEM); enables TLS together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "server private key (PEM)")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle (PEM) used to verify client certificates")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "reject clients without a valid certificate (mutual TLS)")
+	flag.Parse()
+
+	config := mvcamctrl.DefaultConfig()
+	if *configFile != "" {
+		var err error
+		config, err = mvcamctrl.LoadConfig(*configFile)
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	if value := os.Getenv("MVPULSE_LISTEN"); value != "" {
+		config.Listen = strings.Split(value, ",")
+	}
+	if value := os.Getenv("MVPULSE_HTTP"); value != "" {
+		config.HTTPListen = strings.Split(value, ",")
+	}
+	if value := os.Getenv("MVPULSE_DEVICE"); value != "" {
+		config.DefaultDevice = value
+	}
+	if value := os.Getenv("MVPULSE_LOG_LEVEL"); value != "" {
+		config.Log.Level = value
+	}
+	if value := os.Getenv("MVPULSE_MQTT"); value != "" {
+		config.MQTT = &mvcamctrl.MQTTConfig{Broker: value}
+	}
+	if value := os.Getenv("MVPULSE_SIMULATE"); value != "" && value != "0" && value != "false" {
+		if *simulateCount <= 0 {
+			fail(fmt.Errorf("-simulate-count must be at least 1, not %d", *simulateCount))
+		}
+		config.Simulate = *simulateCount
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			config.Listen = strings.Split(*listen, ",")
+		case "http":
+			config.HTTPListen = strings.Split(*httpListen, ",")
+		case "device":
+			config.DefaultDevice = *device
+		case "baud":
+			config.Serial.BaudRate = *baudRate
+		case "simulate":
+			config.Simulate = 0
+			if *simulate {
+				if *simulateCount <= 0 {
+					err = fmt.Errorf("-simulate-count must be at least 1, not %d", *simulateCount)
+				}
+				config.Simulate = *simulateCount
+			}
+		case "simulate-count":
+			// flags are visited in lexical order, after -simulate
+			if config.Simulate > 0 {
+				config.Simulate = *simulateCount
+			}
+		case "deadman":
+			config.DeadManTimeout = mvcamctrl.Duration(*deadMan)
+		case "mqtt":
+			if config.MQTT == nil {
+				config.MQTT = &mvcamctrl.MQTTConfig{}
+			}
+			config.MQTT.Broker = *mqttBroker
+		case "audit":
+			config.AuditLog = *auditLog
+		case "history":
+			config.History = *historyFile
+		case "safety":
+			config.Safety, err = safety.LoadPolicies(*policyFile)
+		case "auth":
+			config.Auth, err = mvcamctrl.LoadAuthOptions(*authFile)
+		case "tls-cert":
+			tlsConfig(&config).CertFile = *tlsCert
+		case "tls-key":
+			tlsConfig(&config).KeyFile = *tlsKey
+		case "tls-client-ca":
+			tlsConfig(&config).ClientCAFile = *tlsClientCA
+		case "tls-require-client-cert":
+			tlsConfig(&config).RequireClientCert = *tlsRequireClientCert
+		case "log-level":
+			config.Log.Level = *logLevel
+		case "log-format":
+			config.Log.Format = *logFormat
+		case "log-file":
+			config.Log.File = *logFile
+		case "trace":
+			config.Tracing.Exporter = *traceExporter
+		case "trace-endpoint":
+			config.Tracing.Endpoint = *traceEndpoint
+		}
+		if err != nil {
+			fail(err)
+		}
+	})
+
+	err = logs.Setup(config.Log)
+	if err != nil {
+		fail(err)
+	}
+
+	log.Info("Starting server")
+	server, err := mvcamctrl.StartServer(config)
+	if err != nil {
+		fail(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Noticef("Received %s, shutting down", sig)
+		server.Stop()
+
+		// a second signal aborts a shutdown that hangs
+		<-signals
+		os.Exit(1)
+	}()
+
+	err = server.Wait()
+	server.Stop()
+	if err != nil {
+		fail(err)
+	}
+}
+
+// The TLS options of the configuration, created when the configuration file has none, so that each flag overrides
+// only its own setting.
+func tlsConfig(config *mvcamctrl.Config) *mvcamctrl.TLSOptions {
+	if config.TLS == nil {
+		config.TLS = &mvcamctrl.TLSOptions{}
+	}
+	return config.TLS
+}
+
+// Errors before the logging is set up go to the standard error in the default format.
+func fail(err error) {
+	log.Criticalf("%s", err)
+	os.Exit(1)
 }
@@ -0,0 +1,141 @@
+package safety
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+)
+
+// Limits a pulse configuration has to respect. Zero values disable the corresponding check.
+type Policy struct {
+	MaxExposureTick uint32 `json:"max_exposure_tick"`
+	MaxDelayTick    uint32 `json:"max_delay_tick"`
+
+	// Highest fraction (0..1) of the trigger period the laser may be on. Requires TriggerRate and TickMicroseconds.
+	MaxDutyCycle float64 `json:"max_duty_cycle"`
+	// Expected trigger rate in Hz.
+	TriggerRate float64 `json:"trigger_rate"`
+	// Length of one firmware tick in microseconds.
+	TickMicroseconds float64 `json:"tick_microseconds"`
+}
+
+// Whether the policy sets no limit at all.
+func (p Policy) Empty() bool {
+	return p == Policy{}
+}
+
+// Check the configuration against the policy. Fields that are not set in the configuration are not checked.
+func (p Policy) CheckPulse(config *mvpulse.PulseConfiguration) error {
+	if config == nil {
+		return nil
+	}
+
+	if p.MaxExposureTick != 0 && config.ExposureTick != nil && config.ExposureTick.Value > p.MaxExposureTick {
+		return fmt.Errorf("exposure tick %d exceeds the limit of %d", config.ExposureTick.Value, p.MaxExposureTick)
+	}
+
+	if p.MaxDelayTick != 0 && config.PulseDelay != nil && config.PulseDelay.Value > p.MaxDelayTick {
+		return fmt.Errorf("pulse delay tick %d exceeds the limit of %d", config.PulseDelay.Value, p.MaxDelayTick)
+	}
+
+	if p.MaxDutyCycle != 0 && p.TriggerRate != 0 && p.TickMicroseconds != 0 && config.ExposureTick != nil {
+		periodTick := 1e6 / p.TriggerRate / p.TickMicroseconds
+
+		var delayTick float64
+		if config.PulseDelay != nil {
+			delayTick = float64(config.PulseDelay.Value)
+		}
+		if delayTick+float64(config.ExposureTick.Value) > periodTick {
+			return fmt.Errorf("delay %d + exposure %d ticks does not fit in the trigger period of %.0f ticks at %g Hz",
+				uint32(delayTick), config.ExposureTick.Value, periodTick, p.TriggerRate)
+		}
+
+		dutyCycle := float64(config.ExposureTick.Value) / periodTick
+		if dutyCycle > p.MaxDutyCycle {
+			return fmt.Errorf("duty cycle %.1f%% at %g Hz exceeds the limit of %.1f%%",
+				dutyCycle*100, p.TriggerRate, p.MaxDutyCycle*100)
+		}
+	}
+	return nil
+}
+
+// Policies keeps a default policy and per-device overrides keyed by device name (/dev/serial/by-id) or path.
+type Policies struct {
+	mutex    sync.RWMutex
+	fallback Policy
+	devices  map[string]Policy
+}
+
+type policiesFile struct {
+	Default Policy            `json:"default"`
+	Devices map[string]Policy `json:"devices"`
+}
+
+func NewPolicies(fallback Policy) *Policies {
+	return &Policies{
+		fallback: fallback,
+		devices:  map[string]Policy{},
+	}
+}
+
+// Load policies from a JSON file of the form {"default": {...}, "devices": {"<name or path>": {...}}}
+func LoadPolicies(path string) (*Policies, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := NewPolicies(Policy{})
+	err = json.Unmarshal(content, policies)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse safety policy %s: %s", path, err.Error())
+	}
+	return policies, nil
+}
+
+func (p *Policies) UnmarshalJSON(b []byte) error {
+	var file policiesFile
+	err := json.Unmarshal(b, &file)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.fallback = file.Default
+	p.devices = map[string]Policy{}
+	for device, policy := range file.Devices {
+		p.devices[device] = policy
+	}
+	return nil
+}
+
+func (p *Policies) SetDefault(policy Policy) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.fallback = policy
+}
+
+func (p *Policies) Set(device string, policy Policy) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.devices[device] = policy
+}
+
+// Policy that applies to the device. A nil device gets the default policy.
+func (p *Policies) For(device *mvpulse.SerialDevice) Policy {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if device != nil {
+		if policy, ok := p.devices[device.Name]; ok {
+			return policy
+		}
+		if policy, ok := p.devices[device.Path]; ok {
+			return policy
+		}
+	}
+	return p.fallback
+}
@@ -0,0 +1,75 @@
+package safety
+
+import (
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func pulse(exposure, delay uint32) *mvpulse.PulseConfiguration {
+	return &mvpulse.PulseConfiguration{
+		ExposureTick: &wrappers.UInt32Value{Value: exposure},
+		PulseDelay:   &wrappers.UInt32Value{Value: delay},
+	}
+}
+
+func TestPolicy_MaxExposure(t *testing.T) {
+	p := Policy{MaxExposureTick: 1000}
+
+	if err := p.CheckPulse(pulse(1000, 0)); err != nil {
+		t.Fatalf("Exposure at the limit should pass: %s", err)
+	}
+	if err := p.CheckPulse(pulse(1001, 0)); err == nil {
+		t.Fatal("Exposure above the limit should fail")
+	}
+	if err := p.CheckPulse(&mvpulse.PulseConfiguration{}); err != nil {
+		t.Fatalf("Unset exposure should not be checked: %s", err)
+	}
+}
+
+func TestPolicy_DutyCycle(t *testing.T) {
+	// 1 kHz with 1 us ticks: 1000 ticks per period
+	p := Policy{MaxDutyCycle: 0.1, TriggerRate: 1000, TickMicroseconds: 1}
+
+	if err := p.CheckPulse(pulse(100, 500)); err != nil {
+		t.Fatalf("10%% duty cycle should pass: %s", err)
+	}
+	if err := p.CheckPulse(pulse(101, 0)); err == nil {
+		t.Fatal("Duty cycle above 10% should fail")
+	}
+	if err := p.CheckPulse(pulse(100, 950)); err == nil {
+		t.Fatal("Pulse that does not fit in the trigger period should fail")
+	}
+}
+
+func TestPolicies_For(t *testing.T) {
+	dir, err := ioutil.TempDir("", "safety")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "policy.json")
+	err = ioutil.WriteFile(file, []byte(`{"default": {"max_exposure_tick": 100}, "devices": {"laser-a": {"max_exposure_tick": 500}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policies, err := LoadPolicies(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limit := policies.For(&mvpulse.SerialDevice{Name: "laser-a"}).MaxExposureTick; limit != 500 {
+		t.Fatalf("Expected device limit 500, got %d", limit)
+	}
+	if limit := policies.For(&mvpulse.SerialDevice{Name: "laser-b"}).MaxExposureTick; limit != 100 {
+		t.Fatalf("Expected default limit 100, got %d", limit)
+	}
+	if limit := policies.For(nil).MaxExposureTick; limit != 100 {
+		t.Fatalf("Expected default limit 100, got %d", limit)
+	}
+}
@@ -1,5 +1,7 @@
 package command
 
+import "fmt"
+
 type Command byte
 
 const (
@@ -46,3 +48,58 @@ var CommandSetPower = CommandMeta{Command: COMMAND_SET_POWER_1_0, RequestLength:
 var CommandGetPower = CommandMeta{Command: COMMAND_GET_POWER_0_1, RequestLength: 0, ResponseLength: 1}
 var CommandSetPolarity = CommandMeta{Command: COMMAND_SET_POLARITY_1_0, RequestLength: 1, ResponseLength: 0}
 var CommandGetPolarity = CommandMeta{Command: COMMAND_GET_POLARITY_0_1, RequestLength: 0, ResponseLength: 1}
+
+// Every command of the controller.
+var Commands = []CommandMeta{
+	CommandVersion,
+	CommandReset,
+	CommandArmTrigger,
+	CommandCancelTrigger,
+	CommandSetFilter,
+	CommandGetFilter,
+	CommandSetExposure,
+	CommandGetExposure,
+	CommandSetDelay,
+	CommandGetDelay,
+	CommandCommitParameters,
+	CommandSetPower,
+	CommandGetPower,
+	CommandSetPolarity,
+	CommandGetPolarity,
+}
+
+// Lookup finds the request and response lengths of an opcode.
+func Lookup(c Command) (CommandMeta, bool) {
+	for _, meta := range Commands {
+		if meta.Command == c {
+			return meta, true
+		}
+	}
+	return CommandMeta{}, false
+}
+
+var commandNames = map[Command]string{
+	COMMAND_VERSION_0_2:           "version",
+	COMMAND_RESET_0_0:             "reset",
+	COMMAND_ARM_TRIGGER_0_0:       "arm_trigger",
+	COMMAND_CANCEL_TRIGGER_0_0:    "cancel_trigger",
+	COMMAND_SET_FILTER_2_0:        "set_filter",
+	COMMAND_GET_FILTER_0_2:        "get_filter",
+	COMMAND_SET_EXPOSURE_2_0:      "set_exposure",
+	COMMAND_GET_EXPOSURE_0_2:      "get_exposure",
+	COMMAND_SET_DELAY_2_0:         "set_delay",
+	COMMAND_GET_DELAY_0_2:         "get_delay",
+	COMMAND_COMMIT_PARAMETERS_0_0: "commit_parameters",
+	COMMAND_SET_POWER_1_0:         "set_power",
+	COMMAND_GET_POWER_0_1:         "get_power",
+	COMMAND_SET_POLARITY_1_0:      "set_polarity",
+	COMMAND_GET_POLARITY_0_1:      "get_polarity",
+}
+
+// Name of the opcode for logs, or its hex value if it is unknown.
+func (c Command) String() string {
+	if name, ok := commandNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#04x", byte(c))
+}
@@ -0,0 +1,97 @@
+package serial
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// A serial port found by the discovery. Path is the real device node, with symlinks resolved.
+type Device struct {
+	Name string
+	Path string
+}
+
+// Device that is listed whenever its path exists, such as an on-board UART.
+type StaticDevice struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Where the serial devices and their metadata are found. The sources are merged in the order static entries, by-id
+// directory, glob patterns; a device found by several sources is listed once, under the name from the first one.
+type DiscoveryConfig struct {
+	Static []StaticDevice `json:"static"`
+	// Directory of stable, descriptive symlinks to the devices. Skipped when it does not exist.
+	ByIDDir string `json:"by_id_dir"`
+	// Patterns of device nodes such as /dev/ttyUSB*. The file name is the device name.
+	Globs []string `json:"globs"`
+	// Root of the sysfs tree the USB metadata of the ports is read from.
+	SysfsRoot string `json:"sysfs_root"`
+}
+
+func DefaultDiscoveryConfig() DiscoveryConfig {
+	return DiscoveryConfig{
+		ByIDDir:   DirPath,
+		Globs:     []string{"/dev/ttyUSB*", "/dev/ttyACM*"},
+		SysfsRoot: DefaultSysfsRoot,
+	}
+}
+
+// ListDevices returns the devices of every source, sorted by name. Sources that do not exist are skipped.
+func (c DiscoveryConfig) ListDevices() ([]Device, error) {
+	var devices []Device
+	seen := map[string]bool{}
+	add := func(name string, p string) {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil || seen[real] {
+			return
+		}
+		seen[real] = true
+		devices = append(devices, Device{Name: name, Path: real})
+	}
+
+	for _, device := range c.Static {
+		add(device.Name, device.Path)
+	}
+
+	if c.ByIDDir != "" {
+		infos, err := ioutil.ReadDir(c.ByIDDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to list serial devices in %s: %s", c.ByIDDir, err.Error())
+		}
+		for _, info := range infos {
+			add(info.Name(), path.Join(c.ByIDDir, info.Name()))
+		}
+	}
+
+	for _, pattern := range c.Globs {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device pattern %q", pattern)
+		}
+		for _, match := range matches {
+			add(path.Base(match), match)
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices, nil
+}
+
+// FindDevice looks a device up by name. ok is false when no source lists it.
+func (c DiscoveryConfig) FindDevice(name string) (device Device, ok bool, err error) {
+	devices, err := c.ListDevices()
+	if err != nil {
+		return
+	}
+	for _, device = range devices {
+		if device.Name == name {
+			return device, true, nil
+		}
+	}
+	return Device{}, false, nil
+}
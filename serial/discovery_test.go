@@ -0,0 +1,96 @@
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func fakeDev(t *testing.T, byID bool) string {
+	root, err := ioutil.TempDir("", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ttyUSB0", "ttyUSB1", "ttyACM0", "ttyS1"} {
+		err = ioutil.WriteFile(path.Join(root, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if byID {
+		err = os.MkdirAll(path.Join(root, "serial/by-id"), 0755)
+		if err == nil {
+			err = os.Symlink("../../ttyUSB0", path.Join(root, "serial/by-id/usb-FTDI_FT232R_USB_UART_A50285BI-if00-port0"))
+		}
+		if err == nil {
+			err = os.Symlink("../../ttyUSB1", path.Join(root, "serial/by-id/usb-FTDI_FT232R_USB_UART_A7031QXY-if00-port0"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestDiscoveryConfig_ListDevices(t *testing.T) {
+	root := fakeDev(t, true)
+	defer os.RemoveAll(root)
+
+	config := DiscoveryConfig{
+		Static: []StaticDevice{
+			{Name: "laser", Path: path.Join(root, "serial/by-id/usb-FTDI_FT232R_USB_UART_A7031QXY-if00-port0")},
+			{Name: "uart", Path: path.Join(root, "ttyS1")},
+			{Name: "unplugged", Path: path.Join(root, "ttyUSB7")},
+		},
+		ByIDDir: path.Join(root, "serial/by-id"),
+		Globs:   []string{path.Join(root, "ttyUSB*"), path.Join(root, "ttyACM*")},
+	}
+	devices, err := config.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Device{
+		{Name: "laser", Path: path.Join(root, "ttyUSB1")},
+		{Name: "ttyACM0", Path: path.Join(root, "ttyACM0")},
+		{Name: "uart", Path: path.Join(root, "ttyS1")},
+		{Name: "usb-FTDI_FT232R_USB_UART_A50285BI-if00-port0", Path: path.Join(root, "ttyUSB0")},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("Unexpected devices %+v", devices)
+	}
+
+	device, ok, err := config.FindDevice("uart")
+	if err != nil || !ok || device.Path != path.Join(root, "ttyS1") {
+		t.Fatalf("Unexpected lookup result %+v %t %v", device, ok, err)
+	}
+	_, ok, err = config.FindDevice("unplugged")
+	if err != nil || ok {
+		t.Fatal("A static device that does not exist should not be found")
+	}
+}
+
+func TestDiscoveryConfig_WithoutByID(t *testing.T) {
+	root := fakeDev(t, false)
+	defer os.RemoveAll(root)
+
+	config := DiscoveryConfig{
+		ByIDDir: path.Join(root, "serial/by-id"),
+		Globs:   []string{path.Join(root, "ttyUSB*")},
+	}
+	devices, err := config.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].Name != "ttyUSB0" || devices[1].Name != "ttyUSB1" {
+		t.Fatalf("Unexpected devices %+v", devices)
+	}
+
+	config.Globs = []string{"[ttyUSB"}
+	_, err = config.ListDevices()
+	if err == nil {
+		t.Fatal("Expected an invalid pattern to be rejected")
+	}
+}
@@ -0,0 +1,105 @@
+package serial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"go.bug.st/serial.v1"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Time the controller needs after the port is opened before it answers commands.
+const settleDelay = 500 * time.Millisecond
+
+// Versions reported by a pulse controller.
+type ProbeResult struct {
+	HardwareVersion byte
+	FirmwareVersion byte
+}
+
+// Probe opens the port at p, asks for the version and closes the port again. It fails when the port does not answer
+// CommandVersion within timeout, which means it is not a pulse controller.
+func Probe(p string, config Config, timeout time.Duration) (ProbeResult, error) {
+	port, err := serial.Open(p, &serial.Mode{
+		BaudRate: config.BaudRate,
+		DataBits: config.DataBits,
+		Parity:   config.Parity,
+		StopBits: config.StopBits,
+	})
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	time.Sleep(settleDelay)
+	return ProbePort(port, p, config, timeout)
+}
+
+// ProbePort is Probe for a port that is already open, such as a simulated one. The port is closed afterwards.
+func ProbePort(port serial.Port, device string, config Config, timeout time.Duration) (ProbeResult, error) {
+	s := NewSerialWithConfig(config)
+	err := s.connect(port, device)
+	if err != nil {
+		_ = port.Close()
+		return ProbeResult{}, err
+	}
+	defer s.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := SerialCommand{
+		Command:         command.CommandVersion,
+		ResponseChannel: make(chan []byte),
+		Ctx:             ctx,
+	}
+	err = s.WriteCommandAndRegisterResponse(cmd)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	select {
+	case response, ok := <-cmd.ResponseChannel:
+		if !ok {
+			return ProbeResult{}, errors.New("no response to the version command")
+		}
+		if len(response) != 2 {
+			return ProbeResult{}, fmt.Errorf("unexpected version response %v", response)
+		}
+		return ProbeResult{HardwareVersion: response[0], FirmwareVersion: response[1]}, nil
+	case <-ctx.Done():
+		return ProbeResult{}, errors.New("no response to the version command")
+	}
+}
+
+// PortInUse reports whether any process has the device at p open, by looking through /proc/<pid>/fd. Processes whose
+// descriptors cannot be read are not seen, so false is a best guess.
+func PortInUse(p string) bool {
+	device, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
+	}
+	processes, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+	for _, process := range processes {
+		if _, err := strconv.Atoi(process.Name()); err != nil {
+			continue
+		}
+		fdDir := path.Join("/proc", process.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(path.Join(fdDir, fd.Name()))
+			if err == nil && target == device {
+				return true
+			}
+		}
+	}
+	return false
+}
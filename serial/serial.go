@@ -2,14 +2,18 @@ package serial
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/op/go-logging"
+	"github.com/wuyuanyi135/mvcamctrl/logs"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"github.com/wuyuanyi135/mvcamctrl/tracing"
 	"go.bug.st/serial.v1"
-	"io/ioutil"
-	"os"
-	"path"
-	"sync/atomic"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,73 +26,184 @@ const (
 )
 
 type Serial struct {
-	instance serial.Port
 	baudRate int
 	dataBits int
 	stopBits serial.StopBits
 	parity   serial.Parity
 
-	responseWaitingList *atomic.Value
-	serialReceiveChan   chan byte
+	// guards the port and keeps registering and writing a command in the same order as the responses
+	mutex    sync.Mutex
+	instance serial.Port
+	// path of the opened port, for the logs
+	device string
+
+	pending pendingCommands
 }
 
-var log = logging.MustGetLogger("Serial")
+// Commands waiting for their response, in the order they were written. Safe for concurrent use.
+type pendingCommands struct {
+	mutex    sync.Mutex
+	commands []*SerialCommand
+}
 
-func NewSerial() Serial {
-	responseWaitingList := &atomic.Value{}
-	responseWaitingList.Store([]*SerialCommand{})
-	return Serial{
-		instance: nil,
-		baudRate: DefaultBaudRate,
-		dataBits: DefaultDataBits,
-		stopBits: serial.OneStopBit,
-		parity:   serial.NoParity,
+func (p *pendingCommands) add(cmd *SerialCommand) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.commands = append(p.commands, cmd)
+}
 
-		responseWaitingList: responseWaitingList,
-		serialReceiveChan:   nil,
+// Remove the command. Returns false if it is not pending any more.
+func (p *pendingCommands) remove(cmd *SerialCommand) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, v := range p.commands {
+		if v == cmd {
+			p.commands = append(p.commands[:i:i], p.commands[i+1:]...)
+			return true
+		}
 	}
+	return false
 }
 
-// return map[path in /dev/serial/by-id]=path in /dev
-func ListSerialPorts() (map[string]string, error) {
-	dirPath := DirPath
-	infos, e := ioutil.ReadDir(dirPath)
-	if e != nil {
-		errMessage := fmt.Sprintf("Failed to list serial devices in %s", dirPath)
-		return nil, errors.New(errMessage)
+// Remove and return the oldest command waiting for a response to opcode, or nil if there is none.
+func (p *pendingCommands) take(opcode byte) *SerialCommand {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, v := range p.commands {
+		if byte(v.Command.Command) == opcode {
+			p.commands = append(p.commands[:i:i], p.commands[i+1:]...)
+			return v
+		}
 	}
+	return nil
+}
 
-	mapping := map[string]string{}
+func (p *pendingCommands) clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.commands = nil
+}
 
-	for _, port := range infos {
-		destination, e := os.Readlink(path.Join(dirPath, port.Name()))
-		if e != nil {
-			continue
+func (p *pendingCommands) list() []*SerialCommand {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]*SerialCommand(nil), p.commands...)
+}
+
+var (
+	log    = logs.New("Serial")
+	tracer = tracing.Tracer("serial")
+)
+
+// Line settings used when a port is opened.
+type Config struct {
+	BaudRate int
+	DataBits int
+	StopBits serial.StopBits
+	Parity   serial.Parity
+}
+
+var stopBitsNames = map[string]serial.StopBits{
+	"1":   serial.OneStopBit,
+	"1.5": serial.OnePointFiveStopBits,
+	"2":   serial.TwoStopBits,
+}
+
+var parityNames = map[string]serial.Parity{
+	"none":  serial.NoParity,
+	"odd":   serial.OddParity,
+	"even":  serial.EvenParity,
+	"mark":  serial.MarkParity,
+	"space": serial.SpaceParity,
+}
+
+// Decode {"baud_rate": 921600, "data_bits": 8, "stop_bits": "1", "parity": "none"}. Missing fields keep their values.
+func (c *Config) UnmarshalJSON(b []byte) error {
+	var config struct {
+		BaudRate int    `json:"baud_rate"`
+		DataBits int    `json:"data_bits"`
+		StopBits string `json:"stop_bits"`
+		Parity   string `json:"parity"`
+	}
+	err := json.Unmarshal(b, &config)
+	if err != nil {
+		return err
+	}
+
+	if config.BaudRate != 0 {
+		c.BaudRate = config.BaudRate
+	}
+	if config.DataBits != 0 {
+		c.DataBits = config.DataBits
+	}
+	if config.StopBits != "" {
+		stopBits, ok := stopBitsNames[config.StopBits]
+		if !ok {
+			return fmt.Errorf("invalid stop bits %q", config.StopBits)
 		}
-		mapping[port.Name()] = path.Join(dirPath, destination)
+		c.StopBits = stopBits
 	}
-	return mapping, nil
+	if config.Parity != "" {
+		parity, ok := parityNames[strings.ToLower(config.Parity)]
+		if !ok {
+			return fmt.Errorf("invalid parity %q", config.Parity)
+		}
+		c.Parity = parity
+	}
+	return nil
 }
 
-func (s *Serial) ConnectByName(name string) (error, string) {
-	mapping, err := ListSerialPorts()
+func DefaultConfig() Config {
+	return Config{
+		BaudRate: DefaultBaudRate,
+		DataBits: DefaultDataBits,
+		StopBits: serial.OneStopBit,
+		Parity:   serial.NoParity,
+	}
+}
+
+func NewSerial() *Serial {
+	return NewSerialWithConfig(DefaultConfig())
+}
+
+func NewSerialWithConfig(config Config) *Serial {
+	return &Serial{
+		baudRate: config.BaudRate,
+		dataBits: config.DataBits,
+		stopBits: config.StopBits,
+		parity:   config.Parity,
+	}
+}
 
+// return map[device name]=path in /dev, from the default discovery sources
+func ListSerialPorts() (map[string]string, error) {
+	devices, err := DefaultDiscoveryConfig().ListDevices()
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to list port: " + err.Error())
-		return errors.New(errMsg), ""
+		return nil, err
 	}
 
-	return s.ConnectByPath(mapping[name]), mapping[name]
+	mapping := map[string]string{}
+	for _, device := range devices {
+		mapping[device.Name] = device.Path
+	}
+	return mapping, nil
 }
 
-func (s *Serial) ConnectByPath(p string) error {
-	if s.instance != nil {
-		errMsg := fmt.Sprintf("Failed to connect by path: %s is already opened", p)
-		return errors.New(errMsg)
+// Open the device the default discovery sources list under name.
+func (s *Serial) ConnectByName(name string) (error, string) {
+	device, ok, err := DefaultDiscoveryConfig().FindDevice(name)
+	if err != nil {
+		return fmt.Errorf("Failed to list port: %s", err.Error()), ""
 	}
+	if !ok {
+		return fmt.Errorf("no serial device named %q", name), ""
+	}
+
+	return s.ConnectByPath(device.Path), device.Path
+}
 
-	var err error
-	s.instance, err = serial.Open(p, &serial.Mode{
+func (s *Serial) ConnectByPath(p string) error {
+	port, err := serial.Open(p, &serial.Mode{
 		BaudRate: s.baudRate,
 		DataBits: s.dataBits,
 		Parity:   s.parity,
@@ -96,19 +211,52 @@ func (s *Serial) ConnectByPath(p string) error {
 	})
 	if err != nil {
 		errMsg := fmt.Sprintf("failed to connect by path: %s: %s", p, err.Error())
-		s.instance = nil
 		return errors.New(errMsg)
 	}
-	// start serial receive listener
-	s.serialReceiveChan = make(chan byte, ReceiveBufferSize)
-	go s.serialReceiver()
-	go s.responseHandler()
 
-	time.Sleep(500 * time.Millisecond)
+	err = s.connect(port, p)
+	if err != nil {
+		_ = port.Close()
+		errMsg := fmt.Sprintf("Failed to connect by path: %s is already opened", p)
+		return errors.New(errMsg)
+	}
+
+	time.Sleep(settleDelay)
+	return nil
+}
+
+// ConnectPort takes over an already opened port and starts dispatching its responses.
+func (s *Serial) ConnectPort(port serial.Port) error {
+	return s.connect(port, "")
+}
+
+// ConnectPortAs is ConnectPort for a port that stands for the device at p, which is shown in the logs.
+func (s *Serial) ConnectPortAs(port serial.Port, p string) error {
+	return s.connect(port, p)
+}
+
+func (s *Serial) connect(port serial.Port, device string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.instance != nil {
+		return errors.New("a port is already opened")
+	}
+
+	s.instance = port
+	s.device = device
+	s.pending.clear()
+
+	// start serial receive listener
+	logger := log.With(logs.FieldDevice, device)
+	received := make(chan byte, ReceiveBufferSize)
+	go s.serialReceiver(port, received, logger)
+	go s.responseHandler(received, logger)
 	return nil
 }
 
 func (s *Serial) Disconnect() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	if s.instance == nil {
 		return nil
 	}
@@ -116,13 +264,38 @@ func (s *Serial) Disconnect() error {
 	err := s.instance.Close()
 	if err != nil {
 		return err
-	} else {
-		s.instance = nil
-		return nil
 	}
+	s.instance = nil
+	s.device = ""
+	// the callers stop waiting when their context ends
+	s.pending.clear()
+	return nil
+}
+
+// ToggleDTR drops DTR for the given time and raises it again, which resets boards that wire DTR to their reset line.
+// Writes wait until it is done.
+func (s *Serial) ToggleDTR(duration time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.instance == nil {
+		return errors.New("port is not open")
+	}
+
+	err := s.instance.SetDTR(false)
+	if err != nil {
+		return err
+	}
+	time.Sleep(duration)
+	return s.instance.SetDTR(true)
 }
 
 func (s *Serial) WriteCommand(cmd SerialCommand) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.writeCommand(cmd)
+}
+
+func (s *Serial) writeCommand(cmd SerialCommand) error {
 	if s.instance == nil {
 		return errors.New("port is not open")
 	}
@@ -136,6 +309,12 @@ func (s *Serial) WriteCommand(cmd SerialCommand) error {
 }
 
 func (s *Serial) RegisterResponse(cmd *SerialCommand) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.registerResponse(cmd)
+}
+
+func (s *Serial) registerResponse(cmd *SerialCommand) error {
 	if s.instance == nil {
 		return errors.New("serial is not opened")
 	}
@@ -143,183 +322,133 @@ func (s *Serial) RegisterResponse(cmd *SerialCommand) error {
 		return errors.New("response channel is not initialized")
 	}
 
-	list, _ := s.responseWaitingList.Load().([]*SerialCommand)
-	list = append(list, cmd)
-	s.responseWaitingList.Store(list)
-
-	// Move timeout handling to serial handler
-	//if _, ok := cmd.Ctx.Deadline(); ok == true {
-	//	go func() {
-	//		done := cmd.Ctx.Done()
-	//
-	//		if done == nil {
-	//			log.Warning("Unable to cancel the context: %#v", cmd)
-	//			return
-	//		}
-	//
-	//		<-done
-	//
-	//		log.Warning("Timeout handling %#v", cmd)
-	//		err := s.UnregisterExactly(cmd)
-	//		if err != nil {
-	//			log.Errorf("Failed to unregister cmd %#v: %s", cmd, err.Error())
-	//			return
-	//		}
-	//
-	//	}()
-	//}
+	s.pending.add(cmd)
+
+	// drop the command when its context ends before the response arrives
+	if cmd.Ctx != nil && cmd.Ctx.Done() != nil {
+		logger := s.logger(cmd)
+		go func() {
+			<-cmd.Ctx.Done()
+			if s.pending.remove(cmd) {
+				logger.Warningf("No response before the deadline")
+			}
+		}()
+	}
 	return nil
 }
 
 func (s *Serial) UnregisterExactly(cmd *SerialCommand) error {
-	list := s.responseWaitingList.Load().([]*SerialCommand)
-	for i, v := range list {
-		if v == cmd {
-			list = append(list[:i], list[i+1:]...)
-			s.responseWaitingList.Store(list)
-			return nil
-		}
+	if !s.pending.remove(cmd) {
+		return errors.New("Command not found in the queue")
 	}
-	return errors.New("Command not found in the queue")
+	return nil
 }
 
-func (s *Serial) serialReceiver() {
-	if s.instance == nil {
-		log.Error("Can not receive from serial port: port is not opened")
-		return
-	}
-	if s.serialReceiveChan == nil {
-		log.Error("Channel is not initialized")
-		return
-	}
-
+func (s *Serial) serialReceiver(port serial.Port, received chan<- byte, logger *logs.Logger) {
 	// clean up when the function exits
-	defer close(s.serialReceiveChan)
+	defer close(received)
 
 	var recvBuf = make([]byte, 128)
 	for {
-		n, err := s.instance.Read(recvBuf)
+		n, err := port.Read(recvBuf)
 		if err != nil {
-			log.Warning("Serial instance has been removed. Unregister the handler.")
+			logger.Warning("Serial instance has been removed. Unregister the handler.")
 			return
 		}
 
 		for i := 0; i < n; i++ {
-			s.serialReceiveChan <- recvBuf[i]
-		}
-	}
-}
-
-func (s *Serial) timeoutChannels() <-chan *SerialCommand {
-	commands := s.responseWaitingList.Load().([]*SerialCommand)
-	timeoutChan := make(chan *SerialCommand)
-	for _, cmd := range commands {
-		_, ok := cmd.Ctx.Deadline()
-		if ok {
-			// has deadline
-			go func() {
-				<-cmd.Ctx.Done()
-				timeoutChan <- cmd
-			}()
+			received <- recvBuf[i]
 		}
 	}
-	return timeoutChan
 }
 
 // Coroutine function that receive the responses and dispatch them. It should be registered when a port is successfully
 // opened. The handler is deactivated when the port is closed
-func (s *Serial) responseHandler() {
-	var pendingCommand *SerialCommand
-OUTER:
+func (s *Serial) responseHandler(received <-chan byte, logger *logs.Logger) {
 	for {
-		// process the received bytes
-		if s.serialReceiveChan == nil {
-			log.Error("Serial receive channel is not initialized")
+		cmd, ok := <-received
+		if !ok {
+			// channel closed
+			logger.Info("Serial receiver channel closed.")
 			return
 		}
 
-		timeoutChannels := s.timeoutChannels()
-		var cmd byte
-		var ok bool
-		select {
-		case cmd, ok = <-s.serialReceiveChan:
-			if !ok {
-				// channel closed
-				log.Info("Serial receiver channel closed.")
-				return
-			}
-		// continue to process the command
-
-		case timeoutChannel := <-timeoutChannels:
-			// channel timed out, remove it. It does not affect the channel receiving arguments
-			log.Warning("Timeout handling %#v", cmd)
-
-			err := s.UnregisterExactly(timeoutChannel)
-			if err != nil {
-				log.Errorf("Failed to unregister cmd %#v: %s", cmd, err.Error())
-				return
-			}
-			continue OUTER
-		}
-
 		// looking for the pending command for resolving
-		list := s.responseWaitingList.Load().([]*SerialCommand)
-		for _, pendingCommand = range list {
-			if byte(pendingCommand.Command.Command) == cmd {
-
-				// wait for the required arguments fulfilled
-				if pendingCommand.Command.ResponseLength != 0 {
-					responseBuffer := make([]byte, pendingCommand.Command.ResponseLength)
-					for i := 0; i < pendingCommand.Command.ResponseLength; i++ {
-						arg, ok := <-s.serialReceiveChan
-						if !ok {
-							log.Info(ErrorChannelClosed)
-							return
-						}
-						responseBuffer[i] = arg
-					}
-
-					if pendingCommand.ResponseChannel != nil {
-						pendingCommand.ResponseChannel <- responseBuffer
-						close(pendingCommand.ResponseChannel)
-					}
-
-				} else {
-					// this command does not require response argument. Just notify the channel if it exists
-					if pendingCommand.ResponseChannel != nil {
-						pendingCommand.ResponseChannel <- nil
-						close(pendingCommand.ResponseChannel)
-					}
-				}
+		pendingCommand := s.pending.take(cmd)
+		if pendingCommand == nil {
+			logger.With(logs.FieldOpcode, command.Command(cmd).String()).Warningf("Unresolved response")
+			continue
+		}
 
-				// remove the command from the pending position
-				err := s.UnregisterExactly(pendingCommand)
-				if err != nil {
+		// wait for the required arguments fulfilled
+		var responseBuffer []byte
+		if pendingCommand.Command.ResponseLength != 0 {
+			responseBuffer = make([]byte, pendingCommand.Command.ResponseLength)
+			for i := range responseBuffer {
+				responseBuffer[i], ok = <-received
+				if !ok {
+					logger.Info(ErrorChannelClosed)
 					return
 				}
-
-				continue OUTER
 			}
 		}
-		// should not reach here
-		log.Warningf("Unresolved command: %#v", pendingCommand)
+
+		deliver(pendingCommand, responseBuffer)
+	}
+}
+
+// Hand the response to the waiting caller unless it has given up already.
+func deliver(cmd *SerialCommand, response []byte) {
+	if cmd.ResponseChannel == nil {
+		return
+	}
+	var done <-chan struct{}
+	if cmd.Ctx != nil {
+		done = cmd.Ctx.Done()
+	}
+	trace.SpanFromContext(cmd.Ctx).AddEvent("response received")
+	select {
+	case cmd.ResponseChannel <- response:
+		close(cmd.ResponseChannel)
+	case <-done:
+		// the caller waits on its context; a closed channel would read as an empty response
 	}
 }
 
 // shortcut for writing command and register response handler
 func (s *Serial) WriteCommandAndRegisterResponse(cmd SerialCommand) error {
-	err := s.RegisterResponse(&cmd)
+	// the span starts before the lock so that the time spent waiting for the port shows up
+	ctx := cmd.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := tracer.Start(ctx, "serial.write", trace.WithAttributes(tracing.AttributeOpcode.String(cmd.Command.Command.String())))
+	defer span.End()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	span.AddEvent("port acquired")
+	span.SetAttributes(tracing.AttributeDevice.String(s.device), tracing.AttributePending.Int(len(s.pending.list())))
+
+	err := s.registerResponse(&cmd)
 	if err != nil {
-		log.Errorf("Failed to register response: %s", err.Error())
+		s.logger(&cmd).Errorf("Failed to register response: %s", err.Error())
+		span.SetStatus(codes.Error, err.Error())
 		return err
 	}
 
-	err = s.WriteCommand(cmd)
+	err = s.writeCommand(cmd)
 	if err != nil {
-		log.Errorf("Failed to write command: %s", err.Error())
-		_ = s.UnregisterExactly(&cmd)
+		s.logger(&cmd).Errorf("Failed to write command: %s", err.Error())
+		span.SetStatus(codes.Error, err.Error())
+		s.pending.remove(&cmd)
 		return err
 	}
 
 	return nil
 }
+
+// Logger for a command on the opened port. The caller holds the mutex.
+func (s *Serial) logger(cmd *SerialCommand) *logs.Logger {
+	return log.With(logs.FieldDevice, s.device, logs.FieldOpcode, cmd.Command.Command.String())
+}
@@ -0,0 +1,295 @@
+package serial
+
+import (
+	"context"
+	"fmt"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"github.com/wuyuanyi135/mvcamctrl/tracing"
+	"go.bug.st/serial.v1"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeCommands = []command.CommandMeta{
+	command.CommandVersion,
+	command.CommandReset,
+	command.CommandArmTrigger,
+	command.CommandCancelTrigger,
+	command.CommandSetFilter,
+	command.CommandGetFilter,
+	command.CommandSetExposure,
+	command.CommandGetExposure,
+	command.CommandSetDelay,
+	command.CommandGetDelay,
+	command.CommandCommitParameters,
+	command.CommandSetPower,
+	command.CommandGetPower,
+	command.CommandSetPolarity,
+	command.CommandGetPolarity,
+}
+
+// fakePort answers every packet like the controller: the opcode followed by the response bytes, which are derived
+// from the opcode so that a misrouted response can be told apart.
+type fakePort struct {
+	responses chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// opcodes that are never answered
+	silent map[byte]bool
+}
+
+func newFakePort() *fakePort {
+	return &fakePort{
+		responses: make(chan []byte, 4096),
+		closed:    make(chan struct{}),
+		silent:    map[byte]bool{},
+	}
+}
+
+func fakeResponse(meta command.CommandMeta) []byte {
+	response := make([]byte, meta.ResponseLength)
+	for i := range response {
+		response[i] = byte(meta.Command) + byte(i) + 1
+	}
+	return response
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	select {
+	case response := <-p.responses:
+		return copy(b, response), nil
+	case <-p.closed:
+		return 0, io.EOF
+	}
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	if len(b) == 0 || p.silent[b[0]] {
+		return len(b), nil
+	}
+	for _, meta := range fakeCommands {
+		if byte(meta.Command) == b[0] {
+			p.responses <- append([]byte{b[0]}, fakeResponse(meta)...)
+			break
+		}
+	}
+	return len(b), nil
+}
+
+func (p *fakePort) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *fakePort) SetMode(mode *serial.Mode) error { return nil }
+func (p *fakePort) ResetInputBuffer() error         { return nil }
+func (p *fakePort) ResetOutputBuffer() error        { return nil }
+func (p *fakePort) SetDTR(dtr bool) error           { return nil }
+func (p *fakePort) SetRTS(rts bool) error           { return nil }
+func (p *fakePort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
+
+func request(s *Serial, meta command.CommandMeta, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := SerialCommand{
+		Command:         meta,
+		Arg:             make([]byte, meta.RequestLength),
+		ResponseChannel: make(chan []byte),
+		Ctx:             ctx,
+	}
+	err := s.WriteCommandAndRegisterResponse(cmd)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case response := <-cmd.ResponseChannel:
+		return response, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%#x timed out", byte(meta.Command))
+	}
+}
+
+// Run with -race: many goroutines share the port and every one of them must get the response to its own command.
+func TestSerial_ConcurrentCommands(t *testing.T) {
+	s := NewSerial()
+	err := s.ConnectPort(newFakePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	const workers = 16
+	const iterations = 200
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				meta := fakeCommands[(w+i)%len(fakeCommands)]
+				response, err := request(s, meta, time.Second)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(response) != string(fakeResponse(meta)) {
+					errs <- fmt.Errorf("%#x got response %v", byte(meta.Command), response)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if pending := s.pending.list(); len(pending) != 0 {
+		t.Fatalf("Expected no pending command but got %d", len(pending))
+	}
+}
+
+func TestSerial_UnansweredCommand(t *testing.T) {
+	s := NewSerial()
+	port := newFakePort()
+	port.silent[byte(command.CommandReset.Command)] = true
+	err := s.ConnectPort(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	_, err = request(s, command.CommandReset, 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("Expected the reset to time out")
+	}
+
+	// the abandoned command must not take the next response
+	response, err := request(s, command.CommandVersion, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != string(fakeResponse(command.CommandVersion)) {
+		t.Fatalf("Unexpected version response %v", response)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.pending.list()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out command is still pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A caller that gave up must not see a closed channel, which would read as an empty response.
+func TestDeliver_AbandonedCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cmd := &SerialCommand{
+		Command:         command.CommandGetPower,
+		ResponseChannel: make(chan []byte),
+		Ctx:             ctx,
+	}
+	deliver(cmd, []byte{1})
+
+	select {
+	case response, ok := <-cmd.ResponseChannel:
+		t.Fatalf("Expected no response but got %v (open %t)", response, ok)
+	default:
+	}
+}
+
+func TestSerial_ConnectTwice(t *testing.T) {
+	s := NewSerial()
+	err := s.ConnectPort(newFakePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	if s.ConnectPort(newFakePort()) == nil {
+		t.Fatal("Expected the second port to be rejected")
+	}
+}
+
+func TestSerial_WriteSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	s := NewSerial()
+	err := s.ConnectPort(newFakePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx, parent := otel.Tracer("test").Start(ctx, "request")
+	cmd := SerialCommand{
+		Command:         command.CommandVersion,
+		ResponseChannel: make(chan []byte),
+		Ctx:             ctx,
+	}
+	err = s.WriteCommandAndRegisterResponse(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-cmd.ResponseChannel
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "serial.write" || spans[1].Name() != "request" {
+		t.Fatalf("Unexpected spans: %v", spans)
+	}
+	write := spans[0]
+	if write.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Fatal("The write span should be a child of the request")
+	}
+	opcode := ""
+	for _, a := range write.Attributes() {
+		if a.Key == tracing.AttributeOpcode {
+			opcode = a.Value.AsString()
+		}
+	}
+	if opcode != command.CommandVersion.Command.String() {
+		t.Fatalf("Unexpected opcode attribute %q", opcode)
+	}
+	if events := spans[1].Events(); len(events) != 1 || events[0].Name != "response received" {
+		t.Fatalf("Unexpected request events: %v", events)
+	}
+}
+
+func TestProbePort(t *testing.T) {
+	result, err := ProbePort(newFakePort(), "controller", DefaultConfig(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := fakeResponse(command.CommandVersion)
+	if result.HardwareVersion != version[0] || result.FirmwareVersion != version[1] {
+		t.Fatalf("Unexpected versions %+v", result)
+	}
+
+	other := newFakePort()
+	other.silent[byte(command.CommandVersion.Command)] = true
+	_, err = ProbePort(other, "other", DefaultConfig(), 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("Expected a port that does not answer to fail the probe")
+	}
+	select {
+	case <-other.closed:
+	default:
+		t.Fatal("The probed port should be closed")
+	}
+}
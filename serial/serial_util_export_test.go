@@ -9,6 +9,11 @@ import (
 
 func TestSerial_RegisterResponse(t *testing.T) {
 	s := NewSerial()
+	err := s.ConnectPort(newFakePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
 	c := make(chan []byte)
 	ctx := context.Background()
 	cmd := &SerialCommand{
@@ -17,13 +22,13 @@ func TestSerial_RegisterResponse(t *testing.T) {
 		Ctx:             ctx,
 		Arg:             nil,
 	}
-	err := s.RegisterResponse(cmd)
+	err = s.RegisterResponse(cmd)
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	list := s.responseWaitingList.Load().([]*SerialCommand)
+	list := s.pending.list()
 	if len(list) != 1 {
 		t.Fatalf("Expected 1 item in the list but got %d", len(list))
 	}
@@ -36,6 +41,11 @@ func TestSerial_RegisterResponse(t *testing.T) {
 
 func TestSerial_RegisterResponseWithDelay(t *testing.T) {
 	s := NewSerial()
+	err := s.ConnectPort(newFakePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
 	c := make(chan []byte)
 	ctx, _ := context.WithTimeout(context.Background(), time.Second)
 	cmd := &SerialCommand{
@@ -44,11 +54,11 @@ func TestSerial_RegisterResponseWithDelay(t *testing.T) {
 		Ctx:             ctx,
 		Arg:             nil,
 	}
-	err := s.RegisterResponse(cmd)
+	err = s.RegisterResponse(cmd)
 	if err != nil {
 		t.Fatal(err)
 	}
-	list := s.responseWaitingList.Load().([]*SerialCommand)
+	list := s.pending.list()
 	if len(list) != 1 {
 		t.Fatalf("Expected 1 item in the list but got %d", len(list))
 	}
@@ -59,7 +69,7 @@ func TestSerial_RegisterResponseWithDelay(t *testing.T) {
 	}
 
 	<-time.After(2 * time.Second)
-	list = s.responseWaitingList.Load().([]*SerialCommand)
+	list = s.pending.list()
 	if len(list) != 0 {
 		t.Fatalf("Expected 0 item in the list but got %d", len(list))
 	}
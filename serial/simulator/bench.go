@@ -0,0 +1,55 @@
+package simulator
+
+import (
+	"fmt"
+	mvserial "github.com/wuyuanyi135/mvcamctrl/serial"
+	"go.bug.st/serial.v1"
+)
+
+// Bench is a set of virtual controllers that are listed and opened in place of the serial ports of the host. It has
+// the ListDevices and FindDevice methods of serial.DiscoveryConfig.
+type Bench struct {
+	devices     []mvserial.Device
+	controllers map[string]*Controller
+}
+
+// NewBench creates count controllers named simulated-pulse-0, simulated-pulse-1... at the paths sim://pulse0,
+// sim://pulse1...
+func NewBench(count int) *Bench {
+	b := &Bench{
+		controllers: make(map[string]*Controller),
+	}
+	for i := 0; i < count; i++ {
+		device := mvserial.Device{
+			Name: fmt.Sprintf("simulated-pulse-%d", i),
+			Path: fmt.Sprintf("sim://pulse%d", i),
+		}
+		b.devices = append(b.devices, device)
+		b.controllers[device.Path] = New()
+	}
+	return b
+}
+
+func (b *Bench) ListDevices() ([]mvserial.Device, error) {
+	devices := make([]mvserial.Device, len(b.devices))
+	copy(devices, b.devices)
+	return devices, nil
+}
+
+func (b *Bench) FindDevice(name string) (device mvserial.Device, ok bool, err error) {
+	for _, device := range b.devices {
+		if device.Name == name {
+			return device, true, nil
+		}
+	}
+	return mvserial.Device{}, false, nil
+}
+
+// Open connects a new port to the controller at p.
+func (b *Bench) Open(p string) (serial.Port, error) {
+	controller, ok := b.controllers[p]
+	if !ok {
+		return nil, fmt.Errorf("no simulated controller at %s", p)
+	}
+	return controller.Open(), nil
+}
@@ -0,0 +1,209 @@
+// Package simulator models the pulse controller in memory, so that the daemon can run without the hardware.
+package simulator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"go.bug.st/serial.v1"
+	"io"
+	"sync"
+)
+
+// Versions the virtual controllers report.
+const (
+	HardwareVersion = 1
+	FirmwareVersion = 0
+)
+
+// Controller is one virtual pulse controller. Like the hardware, it keeps its settings while no port is open, and a
+// reset switches the power off, disarms the trigger and loads the committed parameters again.
+type Controller struct {
+	mutex     sync.Mutex
+	power     bool
+	armed     bool
+	current   registers
+	committed registers
+}
+
+type registers struct {
+	exposure uint16
+	filter   uint16
+	delay    uint16
+	polarity bool
+}
+
+func New() *Controller {
+	return &Controller{}
+}
+
+// Open connects a new port to the controller. The port speaks the serial protocol of the hardware and can be attached
+// with serial.Serial.ConnectPort in place of a tty.
+func (c *Controller) Open() serial.Port {
+	return &port{
+		controller: c,
+		responses:  make(chan []byte, 64),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (c *Controller) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.power = false
+	c.armed = false
+	c.current = c.committed
+}
+
+// Run one command and return its response without the echoed opcode.
+func (c *Controller) execute(meta command.CommandMeta, arg []byte) []byte {
+	if meta.Command == command.CommandReset.Command {
+		c.reset()
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	response := make([]byte, meta.ResponseLength)
+	switch meta.Command {
+	case command.CommandVersion.Command:
+		response[0], response[1] = HardwareVersion, FirmwareVersion
+	case command.CommandArmTrigger.Command:
+		c.armed = true
+	case command.CommandCancelTrigger.Command:
+		c.armed = false
+	case command.CommandSetFilter.Command:
+		c.current.filter = binary.LittleEndian.Uint16(arg)
+	case command.CommandGetFilter.Command:
+		binary.LittleEndian.PutUint16(response, c.current.filter)
+	case command.CommandSetExposure.Command:
+		c.current.exposure = binary.LittleEndian.Uint16(arg)
+	case command.CommandGetExposure.Command:
+		binary.LittleEndian.PutUint16(response, c.current.exposure)
+	case command.CommandSetDelay.Command:
+		c.current.delay = binary.LittleEndian.Uint16(arg)
+	case command.CommandGetDelay.Command:
+		binary.LittleEndian.PutUint16(response, c.current.delay)
+	case command.CommandCommitParameters.Command:
+		c.committed = c.current
+	case command.CommandSetPower.Command:
+		c.power = arg[0] == 1
+	case command.CommandGetPower.Command:
+		response[0] = boolByte(c.power)
+	case command.CommandSetPolarity.Command:
+		c.current.polarity = arg[0] == 1
+	case command.CommandGetPolarity.Command:
+		response[0] = boolByte(c.current.polarity)
+	}
+	return response
+}
+
+func boolByte(value bool) byte {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// port answers every complete command with its opcode followed by the response bytes. A command may arrive over
+// several writes, but a write must not go beyond the end of the command. Unknown opcodes and extra argument bytes
+// fail the write, so that a driver bug shows up instead of being dropped like the firmware would.
+type port struct {
+	controller *Controller
+
+	// bytes of a command whose argument has not been fully written yet
+	inputMutex sync.Mutex
+	input      []byte
+
+	responses chan []byte
+	// rest of a response that did not fit in the buffer of the last Read; only touched by Read
+	unread []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *port) Read(b []byte) (int, error) {
+	if len(p.unread) == 0 {
+		select {
+		case p.unread = <-p.responses:
+		case <-p.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, p.unread)
+	p.unread = p.unread[n:]
+	return n, nil
+}
+
+func (p *port) Write(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, errors.New("port is closed")
+	default:
+	}
+
+	p.inputMutex.Lock()
+	defer p.inputMutex.Unlock()
+	p.input = append(p.input, b...)
+	if len(p.input) == 0 {
+		return 0, nil
+	}
+	meta, ok := command.Lookup(command.Command(p.input[0]))
+	if !ok {
+		opcode := p.input[0]
+		p.input = nil
+		return 0, fmt.Errorf("unknown opcode %#x", opcode)
+	}
+	length := 1 + meta.RequestLength
+	if len(p.input) < length {
+		// the rest of the argument follows in the next write
+		return len(b), nil
+	}
+	if len(p.input) > length {
+		extra := len(p.input) - length
+		p.input = nil
+		return 0, fmt.Errorf("%d bytes after the %d byte argument of %s", extra, meta.RequestLength, meta.Command)
+	}
+
+	response := append([]byte{p.input[0]}, p.controller.execute(meta, p.input[1:])...)
+	p.input = nil
+	select {
+	case p.responses <- response:
+	case <-p.closed:
+		return 0, errors.New("port is closed")
+	}
+	return len(b), nil
+}
+
+func (p *port) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+// Dropping DTR resets the controller, like on the boards that wire DTR to their reset line.
+func (p *port) SetDTR(dtr bool) error {
+	if !dtr {
+		p.controller.reset()
+	}
+	return nil
+}
+
+// Discard the responses that have not been read yet.
+func (p *port) ResetInputBuffer() error {
+	for {
+		select {
+		case <-p.responses:
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *port) SetMode(mode *serial.Mode) error { return nil }
+func (p *port) ResetOutputBuffer() error        { return nil }
+func (p *port) SetRTS(rts bool) error           { return nil }
+func (p *port) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{}, nil
+}
@@ -0,0 +1,137 @@
+package simulator
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/wuyuanyi135/mvcamctrl/serial"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"testing"
+	"time"
+)
+
+func request(t *testing.T, s *serial.Serial, meta command.CommandMeta, arg []byte) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cmd := serial.SerialCommand{
+		Command:         meta,
+		Arg:             arg,
+		ResponseChannel: make(chan []byte),
+		Ctx:             ctx,
+	}
+	err := s.WriteCommandAndRegisterResponse(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case response := <-cmd.ResponseChannel:
+		return response
+	case <-ctx.Done():
+		t.Fatalf("No response to %s", meta.Command)
+		return nil
+	}
+}
+
+func uint16Arg(value uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, value)
+	return b
+}
+
+func TestController_Protocol(t *testing.T) {
+	controller := New()
+	s := serial.NewSerial()
+	err := s.ConnectPortAs(controller.Open(), "sim://test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := request(t, s, command.CommandVersion, nil)
+	if version[0] != HardwareVersion || version[1] != FirmwareVersion {
+		t.Fatalf("Unexpected version %v", version)
+	}
+
+	request(t, s, command.CommandSetExposure, uint16Arg(700))
+	request(t, s, command.CommandCommitParameters, nil)
+	request(t, s, command.CommandSetExposure, uint16Arg(900))
+	request(t, s, command.CommandSetPower, []byte{1})
+	if exposure := binary.LittleEndian.Uint16(request(t, s, command.CommandGetExposure, nil)); exposure != 900 {
+		t.Fatalf("Expected exposure 900 but got %d", exposure)
+	}
+	if power := request(t, s, command.CommandGetPower, nil); power[0] != 1 {
+		t.Fatalf("Expected the power on but got %v", power)
+	}
+
+	// the settings survive closing the port; a reset loads the committed parameters and switches the power off
+	err = s.Disconnect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ConnectPortAs(controller.Open(), "sim://test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exposure := binary.LittleEndian.Uint16(request(t, s, command.CommandGetExposure, nil)); exposure != 900 {
+		t.Fatalf("Expected exposure 900 after reopening but got %d", exposure)
+	}
+	request(t, s, command.CommandReset, nil)
+	if exposure := binary.LittleEndian.Uint16(request(t, s, command.CommandGetExposure, nil)); exposure != 700 {
+		t.Fatalf("Expected the committed exposure 700 after reset but got %d", exposure)
+	}
+	if power := request(t, s, command.CommandGetPower, nil); power[0] != 0 {
+		t.Fatalf("Expected the power off after reset but got %v", power)
+	}
+}
+
+func TestBench_Devices(t *testing.T) {
+	bench := NewBench(2)
+	devices, err := bench.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[1].Name != "simulated-pulse-1" || devices[1].Path != "sim://pulse1" {
+		t.Fatalf("Unexpected devices %+v", devices)
+	}
+	device, ok, err := bench.FindDevice("simulated-pulse-0")
+	if err != nil || !ok || device.Path != "sim://pulse0" {
+		t.Fatalf("Unexpected lookup result %+v %t %v", device, ok, err)
+	}
+	if _, err := bench.Open("/dev/ttyUSB0"); err == nil {
+		t.Fatal("Expected opening a path without a controller to fail")
+	}
+}
+
+func TestPort_RejectsMalformedCommands(t *testing.T) {
+	port := New().Open()
+	defer port.Close()
+
+	writes := []struct {
+		bytes []byte
+		fails bool
+	}{
+		{[]byte{0xff}, true},
+		// a version command with an argument it does not take
+		{[]byte{byte(command.CommandVersion.Command), 0}, true},
+		{[]byte{byte(command.CommandSetExposure.Command), 0x2c, 0x01, 0}, true},
+		// an argument may follow in a separate write
+		{[]byte{byte(command.CommandSetExposure.Command), 0x2c}, false},
+		{[]byte{0x01}, false},
+		{[]byte{byte(command.CommandVersion.Command)}, false},
+	}
+	for _, write := range writes {
+		_, err := port.Write(write.bytes)
+		if (err != nil) != write.fails {
+			t.Errorf("Write % x: unexpected error %v", write.bytes, err)
+		}
+	}
+
+	// only the two well-formed commands were answered
+	response := make([]byte, 16)
+	n, err := port.Read(response)
+	if err != nil || n != 1 || response[0] != byte(command.CommandSetExposure.Command) {
+		t.Fatalf("Unexpected first response % x, %v", response[:n], err)
+	}
+	n, err = port.Read(response)
+	if err != nil || n != 3 || response[0] != byte(command.CommandVersion.Command) {
+		t.Fatalf("Unexpected second response % x, %v", response[:n], err)
+	}
+}
@@ -0,0 +1,64 @@
+package serial
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const DefaultSysfsRoot = "/sys"
+
+// Description of the USB device behind a serial port, as the kernel reports it in sysfs.
+type USBInfo struct {
+	// Hexadecimal IDs such as "0403" and "6001".
+	VendorID     string
+	ProductID    string
+	Manufacturer string
+	Product      string
+	SerialNumber string
+	// Port path on the bus such as "1-2.4". It stays the same as long as the device is plugged into the same port.
+	BusPath string
+}
+
+// ReadUSBInfo looks up the USB device of the serial port at devicePath in the sysfs tree at sysfsRoot. It returns nil
+// for ports that are not on USB, such as on-board UARTs.
+func ReadUSBInfo(sysfsRoot string, devicePath string) *USBInfo {
+	if resolved, err := filepath.EvalSymlinks(devicePath); err == nil {
+		devicePath = resolved
+	}
+	// /sys/class/tty/ttyUSB0/device points at the USB interface, or at a child of it for USB serial converters
+	dir, err := filepath.EvalSymlinks(path.Join(sysfsRoot, "class/tty", path.Base(devicePath), "device"))
+	if err != nil {
+		return nil
+	}
+
+	root := path.Clean(sysfsRoot)
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	for ; dir != root && dir != "/" && dir != "."; dir = path.Dir(dir) {
+		vendor := readAttribute(dir, "idVendor")
+		if vendor == "" {
+			continue
+		}
+		return &USBInfo{
+			VendorID:     vendor,
+			ProductID:    readAttribute(dir, "idProduct"),
+			Manufacturer: readAttribute(dir, "manufacturer"),
+			Product:      readAttribute(dir, "product"),
+			SerialNumber: readAttribute(dir, "serial"),
+			BusPath:      path.Base(dir),
+		}
+	}
+	return nil
+}
+
+// Content of a sysfs attribute file, or empty if it does not exist.
+func readAttribute(dir string, name string) string {
+	content, err := ioutil.ReadFile(path.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
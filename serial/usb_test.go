@@ -0,0 +1,86 @@
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Lay out the sysfs entries of an FTDI converter on ttyUSB0, a CDC ACM device on ttyACM0 and an on-board ttyS0.
+func fakeSysfs(t *testing.T) string {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"devices/pci0000:00/0000:00:14.0/usb1/1-2/idVendor":                        "0403\n",
+		"devices/pci0000:00/0000:00:14.0/usb1/1-2/idProduct":                       "6001\n",
+		"devices/pci0000:00/0000:00:14.0/usb1/1-2/manufacturer":                    "FTDI\n",
+		"devices/pci0000:00/0000:00:14.0/usb1/1-2/product":                         "FT232R USB UART\n",
+		"devices/pci0000:00/0000:00:14.0/usb1/1-2/serial":                          "A50285BI\n",
+		"devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/ttyUSB0/tty/ttyUSB0/dev": "188:0\n",
+		"devices/pci0000:00/0000:00:14.0/usb1/1-3.1/idVendor":                      "2341\n",
+		"devices/pci0000:00/0000:00:14.0/usb1/1-3.1/idProduct":                     "0043\n",
+		"devices/pci0000:00/0000:00:14.0/usb1/1-3.1/1-3.1:1.0/tty/ttyACM0/dev":     "166:0\n",
+		"devices/pnp0/00:01/tty/ttyS0/dev":                                         "4:64\n",
+	}
+	for name, content := range files {
+		file := path.Join(root, name)
+		err = os.MkdirAll(path.Dir(file), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(file, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"class/tty/ttyUSB0/device": "../../../devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/ttyUSB0",
+		"class/tty/ttyACM0/device": "../../../devices/pci0000:00/0000:00:14.0/usb1/1-3.1/1-3.1:1.0",
+		"class/tty/ttyS0/device":   "../../../devices/pnp0/00:01",
+	}
+	for name, target := range links {
+		link := path.Join(root, name)
+		err = os.MkdirAll(path.Dir(link), 0755)
+		if err == nil {
+			err = os.Symlink(target, link)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestReadUSBInfo(t *testing.T) {
+	root := fakeSysfs(t)
+	defer os.RemoveAll(root)
+
+	ftdi := ReadUSBInfo(root, "/dev/ttyUSB0")
+	expected := USBInfo{
+		VendorID:     "0403",
+		ProductID:    "6001",
+		Manufacturer: "FTDI",
+		Product:      "FT232R USB UART",
+		SerialNumber: "A50285BI",
+		BusPath:      "1-2",
+	}
+	if ftdi == nil || *ftdi != expected {
+		t.Fatalf("Unexpected ttyUSB0 info %+v", ftdi)
+	}
+
+	acm := ReadUSBInfo(root, "/dev/ttyACM0")
+	if acm == nil || acm.VendorID != "2341" || acm.ProductID != "0043" || acm.SerialNumber != "" || acm.BusPath != "1-3.1" {
+		t.Fatalf("Unexpected ttyACM0 info %+v", acm)
+	}
+
+	if info := ReadUSBInfo(root, "/dev/ttyS0"); info != nil {
+		t.Fatalf("Expected no USB info for an on-board UART but got %+v", info)
+	}
+	if info := ReadUSBInfo(root, "/dev/ttyUSB9"); info != nil {
+		t.Fatalf("Expected no USB info for a missing port but got %+v", info)
+	}
+}
@@ -0,0 +1,64 @@
+package mvcamctrl
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/wuyuanyi135/mvcamctrl/audit"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+)
+
+// Record a state-changing operation in the audit log. err is the result of the operation.
+func (s *PulseSerice) audit(ctx context.Context, operation string, oldValue interface{}, newValue interface{}, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+
+	auditErr := s.AuditLog.Record(audit.Entry{
+		Operation: operation,
+		Peer:      callerAddress(ctx),
+		Identity:  callerIdentity(ctx),
+		Old:       auditValue(oldValue),
+		New:       auditValue(newValue),
+		Result:    result,
+	})
+	if auditErr != nil {
+		log.Errorf("Failed to write audit log for %s: %s", operation, auditErr.Error())
+	}
+}
+
+func auditValue(value interface{}) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		log.Warningf("Failed to encode audit value: %s", err.Error())
+		return nil
+	}
+	return content
+}
+
+func (s *PulseSerice) GetAuditLog(ctx context.Context, req *mvpulse.GetAuditLogReq) (resp *mvpulse.GetAuditLogRes, err error) {
+	resp = &mvpulse.GetAuditLogRes{}
+
+	for _, entry := range s.AuditLog.Recent(int(req.Limit)) {
+		timestamp, err := ptypes.TimestampProto(entry.Time)
+		if err != nil {
+			return nil, err
+		}
+		resp.Entries = append(resp.Entries, &mvpulse.AuditEntry{
+			Sequence:  entry.Sequence,
+			Time:      timestamp,
+			Operation: entry.Operation,
+			Peer:      entry.Peer,
+			Identity:  entry.Identity,
+			OldValue:  string(entry.Old),
+			NewValue:  string(entry.New),
+			Result:    entry.Result,
+			Hash:      entry.Hash,
+		})
+	}
+	return
+}
@@ -0,0 +1,236 @@
+package mvcamctrl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	// dashboards and monitoring: read the device state
+	RoleRead
+	// operators: change power, pulse parameters and the trigger
+	RoleOperator
+	// administrators: open, close and reset the device
+	RoleAdmin
+)
+
+var roleNames = map[string]Role{
+	"":         RoleNone,
+	"none":     RoleNone,
+	"read":     RoleRead,
+	"operator": RoleOperator,
+	"admin":    RoleAdmin,
+}
+
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r && name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+func (r *Role) UnmarshalJSON(b []byte) error {
+	var name string
+	err := json.Unmarshal(b, &name)
+	if err != nil {
+		return err
+	}
+	role, ok := roleNames[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown role %q", name)
+	}
+	*r = role
+	return nil
+}
+
+// Role required by each RPC, keyed by method name. Methods that are not listed require RoleAdmin.
+var methodRoles = map[string]Role{
+	"GetDevices":         RoleRead,
+	"DriverVersion":      RoleRead,
+	"DeviceVersion":      RoleRead,
+	"GetPower":           RoleRead,
+	"GetPulseParam":      RoleRead,
+	"GetTriggerArm":      RoleRead,
+	"Opened":             RoleRead,
+	"ParameterStreaming": RoleRead,
+	"GetHistory":         RoleRead,
+
+	"SetPower":        RoleOperator,
+	"SetPulseParam":   RoleOperator,
+	"CommitParameter": RoleOperator,
+	"SetTriggerArm":   RoleOperator,
+	"AcquireLease":    RoleOperator,
+	"RenewLease":      RoleOperator,
+	"ReleaseLease":    RoleOperator,
+
+	"Connect":     RoleAdmin,
+	"Disconnect":  RoleAdmin,
+	"Reset":       RoleAdmin,
+	"GetAuditLog": RoleAdmin,
+	"RawCommand":  RoleAdmin,
+	"SetLogLevel": RoleAdmin,
+}
+
+// Infrastructure services that are always readable, such as server reflection and health checks.
+var publicServicePrefixes = []string{
+	"/grpc.reflection.",
+	"/grpc.health.",
+}
+
+// Role required by the method, given by its full or plain name.
+func requiredRole(method string) Role {
+	role, ok := methodRoles[path.Base(method)]
+	if !ok {
+		return RoleAdmin
+	}
+	return role
+}
+
+func isPublicMethod(fullMethod string) bool {
+	for _, prefix := range publicServicePrefixes {
+		if strings.HasPrefix(fullMethod, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type TokenGrant struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+// AuthOptions maps bearer tokens and client certificate identities to roles.
+type AuthOptions struct {
+	// Role of callers that present neither a known token nor a known certificate. RoleNone rejects them.
+	Anonymous Role `json:"anonymous"`
+	// Bearer token (sent as "authorization: Bearer <token>" metadata) to the granted identity and role.
+	Tokens map[string]TokenGrant `json:"tokens"`
+	// Verified client certificate identity (see CallerIdentity) to role.
+	Certificates map[string]Role `json:"certificates"`
+}
+
+func LoadAuthOptions(file string) (*AuthOptions, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &AuthOptions{}
+	err = json.Unmarshal(content, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse auth configuration %s: %s", file, err.Error())
+	}
+	return options, nil
+}
+
+type Principal struct {
+	Name string
+	Role Role
+}
+
+type principalKey struct{}
+
+// Principal attached to the call by the auth interceptor. ok is false when authorization is disabled.
+func PrincipalFromContext(ctx context.Context) (principal Principal, ok bool) {
+	principal, ok = ctx.Value(principalKey{}).(Principal)
+	return
+}
+
+// Fail unless the caller holds at least the given role. Always succeeds when authorization is disabled.
+func authorize(ctx context.Context, role Role) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || principal.Role >= role {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "%s requires the %s role", principalName(principal), role)
+}
+
+func principalName(principal Principal) string {
+	if principal.Name == "" {
+		return "anonymous caller"
+	}
+	return principal.Name
+}
+
+func (o *AuthOptions) authenticate(ctx context.Context) (Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if !strings.HasPrefix(value, "Bearer ") {
+			continue
+		}
+		grant, ok := o.Tokens[strings.TrimPrefix(value, "Bearer ")]
+		if !ok {
+			return Principal{}, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		return Principal{Name: grant.Name, Role: grant.Role}, nil
+	}
+
+	if identity := callerIdentity(ctx); identity != "" {
+		if role, ok := o.Certificates[identity]; ok {
+			return Principal{Name: identity, Role: role}, nil
+		}
+	}
+
+	if o.Anonymous == RoleNone {
+		return Principal{}, status.Error(codes.Unauthenticated, "credentials required")
+	}
+	return Principal{Role: o.Anonymous}, nil
+}
+
+// Authenticate the caller and check the role required by the method. The principal is attached to the context.
+func (o *AuthOptions) authorizeMethod(ctx context.Context, fullMethod string) (context.Context, error) {
+	if isPublicMethod(fullMethod) {
+		return ctx, nil
+	}
+
+	principal, err := o.authenticate(ctx)
+	if err != nil {
+		log.Warningf("Rejected %s from %s: %s", fullMethod, callerAddress(ctx), err.Error())
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, principalKey{}, principal)
+
+	err = authorize(ctx, requiredRole(fullMethod))
+	if err != nil {
+		log.Warningf("Rejected %s from %s: %s", fullMethod, callerAddress(ctx), err.Error())
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func (o *AuthOptions) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := o.authorizeMethod(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (o *AuthOptions) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := o.authorizeMethod(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = ctx
+		return handler(srv, wrapped)
+	}
+}
@@ -0,0 +1,151 @@
+package mvcamctrl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+const testServicePrefix = "/mvpulse.MicroVisionPulseService/"
+
+var testAuth = &AuthOptions{
+	Tokens: map[string]TokenGrant{
+		"read-token":     {Name: "dashboard", Role: RoleRead},
+		"operator-token": {Name: "bench", Role: RoleOperator},
+		"admin-token":    {Name: "maintainer", Role: RoleAdmin},
+	},
+	Certificates: map[string]Role{
+		"read-pc":     RoleRead,
+		"operator-pc": RoleOperator,
+		"admin-pc":    RoleAdmin,
+	},
+}
+
+func tokenContext(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+// Context of a client that presented a verified certificate with the common name.
+func certificateContext(commonName string) context.Context {
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}},
+	})
+}
+
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// One RPC of each class: read, operator, admin and an unlisted one, which requires admin.
+var roleMethods = []struct {
+	method string
+	role   Role
+}{
+	{"GetPower", RoleRead},
+	{"SetPower", RoleOperator},
+	{"Connect", RoleAdmin},
+	{"Unlisted", RoleAdmin},
+}
+
+func TestAuth_Roles(t *testing.T) {
+	callers := []struct {
+		name string
+		ctx  context.Context
+		role Role
+	}{
+		{"read token", tokenContext("read-token"), RoleRead},
+		{"operator token", tokenContext("operator-token"), RoleOperator},
+		{"admin token", tokenContext("admin-token"), RoleAdmin},
+		{"read certificate", certificateContext("read-pc"), RoleRead},
+		{"operator certificate", certificateContext("operator-pc"), RoleOperator},
+		{"admin certificate", certificateContext("admin-pc"), RoleAdmin},
+	}
+	unary := testAuth.UnaryServerInterceptor()
+	stream := testAuth.StreamServerInterceptor()
+
+	for _, caller := range callers {
+		for _, method := range roleMethods {
+			var principal Principal
+			_, err := unary(caller.ctx, nil, &grpc.UnaryServerInfo{FullMethod: testServicePrefix + method.method},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					principal, _ = PrincipalFromContext(ctx)
+					return nil, nil
+				})
+			allowed := caller.role >= method.role
+			if allowed && err != nil {
+				t.Errorf("%s calling %s: %v", caller.name, method.method, err)
+			}
+			if !allowed && status.Code(err) != codes.PermissionDenied {
+				t.Errorf("%s calling %s: expected PermissionDenied but got %v", caller.name, method.method, err)
+			}
+			if allowed && principal.Role != caller.role {
+				t.Errorf("%s calling %s ran with the %s role", caller.name, method.method, principal.Role)
+			}
+
+			err = stream(nil, &testServerStream{ctx: caller.ctx},
+				&grpc.StreamServerInfo{FullMethod: testServicePrefix + method.method},
+				func(srv interface{}, ss grpc.ServerStream) error {
+					principal, _ = PrincipalFromContext(ss.Context())
+					return nil
+				})
+			if allowed && (err != nil || principal.Role != caller.role) {
+				t.Errorf("%s streaming %s: %v with the %s role", caller.name, method.method, err, principal.Role)
+			}
+			if !allowed && status.Code(err) != codes.PermissionDenied {
+				t.Errorf("%s streaming %s: expected PermissionDenied but got %v", caller.name, method.method, err)
+			}
+		}
+	}
+}
+
+func TestAuth_Authentication(t *testing.T) {
+	callers := []struct {
+		name      string
+		options   *AuthOptions
+		ctx       context.Context
+		code      codes.Code
+		principal string
+	}{
+		{"token", testAuth, tokenContext("read-token"), codes.OK, "dashboard"},
+		{"certificate", testAuth, certificateContext("read-pc"), codes.OK, "read-pc"},
+		{"unknown token", testAuth, tokenContext("guess"), codes.Unauthenticated, ""},
+		// a token is checked before the certificate
+		{"unknown token with a certificate", testAuth, metadata.NewIncomingContext(certificateContext("admin-pc"),
+			metadata.Pairs("authorization", "Bearer guess")), codes.Unauthenticated, ""},
+		{"unknown certificate", testAuth, certificateContext("stranger"), codes.Unauthenticated, ""},
+		{"no credentials", testAuth, context.Background(), codes.Unauthenticated, ""},
+		{"anonymous reader", &AuthOptions{Anonymous: RoleRead}, context.Background(), codes.OK, ""},
+	}
+	for _, caller := range callers {
+		ctx, err := caller.options.authorizeMethod(caller.ctx, testServicePrefix+"GetPower")
+		if status.Code(err) != caller.code {
+			t.Errorf("%s: expected %s but got %v", caller.name, caller.code, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if principal, _ := PrincipalFromContext(ctx); principal.Name != caller.principal {
+			t.Errorf("%s: authenticated as %q, expected %q", caller.name, principal.Name, caller.principal)
+		}
+	}
+
+	// infrastructure services need no credentials
+	if _, err := testAuth.authorizeMethod(context.Background(), "/grpc.health.v1.Health/Check"); err != nil {
+		t.Errorf("health check: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package mvcamctrl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/wuyuanyi135/mvcamctrl/history"
+	"github.com/wuyuanyi135/mvcamctrl/logs"
+	"github.com/wuyuanyi135/mvcamctrl/safety"
+	"github.com/wuyuanyi135/mvcamctrl/serial"
+	"github.com/wuyuanyi135/mvcamctrl/tracing"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	DefaultListenAddress   = ":3050"
+	DefaultShutdownTimeout = 5 * time.Second
+)
+
+// Duration that is written as "30s" in the configuration file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var text string
+	err := json.Unmarshal(b, &text)
+	if err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %s", string(b))
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type Config struct {
+	// Addresses to serve gRPC on: "host:port", "tcp://host:port" or "unix:///path/to/socket".
+	Listen []string `json:"listen"`
+	// Addresses to serve the HTTP/JSON gateway on, in the same forms. Empty disables the gateway.
+	HTTPListen []string `json:"http_listen"`
+	// Device opened at startup, either a /dev/serial/by-id name or a path (absolute, or sim://... when simulating).
+	// Empty opens nothing.
+	DefaultDevice string        `json:"default_device"`
+	Serial        serial.Config `json:"serial"`
+	// How the serial devices are listed.
+	Devices serial.DiscoveryConfig `json:"devices"`
+	// Number of virtual pulse controllers listed and opened instead of the serial ports, for development without the
+	// hardware. Zero uses the serial ports.
+	Simulate int `json:"simulate"`
+
+	// Switch the laser off when no controlling client has been seen for this long. Zero, the default, disables the
+	// dead-man switch.
+	DeadManTimeout Duration `json:"deadman_timeout"`
+	// How often the opened device is sent a heartbeat; must be positive. The result is reported by the gRPC health
+	// service.
+	HealthProbeInterval Duration `json:"health_probe_interval"`
+	// Number of heartbeats in a row the device may miss before it is marked as not responding.
+	HeartbeatFailures int `json:"heartbeat_failures"`
+	// What to do while the device is not responding: "" (nothing), "reconnect" or "dtr" (reset it by toggling DTR).
+	HeartbeatRecovery string `json:"heartbeat_recovery"`
+	// How long Stop waits for calls and streams to finish before closing them.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// Safety limits checked before any configuration reaches the device. Nil means no limits.
+	Safety *safety.Policies `json:"safety"`
+	// Append-only JSON lines file recording every state-changing operation. Empty keeps the log in memory only.
+	AuditLog string `json:"audit_log"`
+	// JSON lines file keeping the event history across restarts. Empty keeps the history in memory only.
+	History string `json:"history"`
+	// Number of events kept in the history.
+	HistorySize int `json:"history_size"`
+	// Serve over TLS when set. Plaintext otherwise.
+	TLS *TLSOptions `json:"tls"`
+	// Authenticate callers and enforce the role of each RPC when set. Every caller has full access otherwise.
+	Auth *AuthOptions `json:"auth"`
+	// Levels, format and destination of the daemon's own log.
+	Log logs.Config `json:"log"`
+	// Bridge the device state and commands to an MQTT broker when set.
+	MQTT *MQTTConfig `json:"mqtt"`
+	// Export spans of the calls and of their serial transactions. Disabled by default.
+	Tracing tracing.Config `json:"tracing"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:          []string{DefaultListenAddress},
+		Serial:          serial.DefaultConfig(),
+		Devices:         serial.DefaultDiscoveryConfig(),
+		ShutdownTimeout: Duration(DefaultShutdownTimeout),
+
+		HealthProbeInterval: Duration(DefaultHealthProbeInterval),
+		HeartbeatFailures:   DefaultHeartbeatFailures,
+		HistorySize:         history.DefaultSize,
+		Log:                 logs.DefaultConfig(),
+	}
+}
+
+// Read a JSON configuration file. Settings missing from the file keep their default values.
+func LoadConfig(file string) (Config, error) {
+	config := DefaultConfig()
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse configuration %s: %s", file, err.Error())
+	}
+	return config, nil
+}
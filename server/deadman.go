@@ -0,0 +1,139 @@
+package mvcamctrl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const minDeadManCheckPeriod = 100 * time.Millisecond
+
+// DeadManSwitch calls the trip function when no controlling client has been seen for the configured timeout. Calls
+// to RPCs that need the operator role count as heartbeats, and a stream opened by an operator keeps the switch
+// satisfied for as long as it lasts. Read-only calls, dashboards with the read role and infrastructure services such
+// as health checks do not count. A zero timeout disables the switch.
+type DeadManSwitch struct {
+	mutex    sync.Mutex
+	timeout  time.Duration
+	lastSeen time.Time
+	streams  int
+	trip     func(idle time.Duration)
+
+	stop chan struct{}
+}
+
+func NewDeadManSwitch(timeout time.Duration, trip func(idle time.Duration)) *DeadManSwitch {
+	return &DeadManSwitch{
+		timeout:  timeout,
+		lastSeen: time.Now(),
+		trip:     trip,
+	}
+}
+
+func (d *DeadManSwitch) SetTimeout(timeout time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.timeout = timeout
+	d.lastSeen = time.Now()
+}
+
+func (d *DeadManSwitch) Heartbeat() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.lastSeen = time.Now()
+}
+
+func (d *DeadManSwitch) StreamOpened() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.streams++
+	d.lastSeen = time.Now()
+}
+
+func (d *DeadManSwitch) StreamClosed() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.streams--
+	d.lastSeen = time.Now()
+}
+
+// Start the supervising goroutine. It runs until Stop is called.
+func (d *DeadManSwitch) Start() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stop != nil {
+		return
+	}
+	d.stop = make(chan struct{})
+	go d.run(d.stop)
+}
+
+func (d *DeadManSwitch) Stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	d.stop = nil
+}
+
+func (d *DeadManSwitch) run(stop chan struct{}) {
+	ticker := time.NewTicker(minDeadManCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		d.mutex.Lock()
+		idle := time.Since(d.lastSeen)
+		expired := d.timeout > 0 && d.streams == 0 && idle >= d.timeout
+		if expired {
+			// restart the period so that the trip function is not hammered while nobody is around
+			d.lastSeen = time.Now()
+		}
+		d.mutex.Unlock()
+
+		if expired {
+			d.trip(idle)
+		}
+	}
+}
+
+// Whether a call to the method controls the device. Methods that are not listed require the admin role.
+func controlMethod(fullMethod string) bool {
+	if isPublicMethod(fullMethod) {
+		return false
+	}
+	return requiredRole(fullMethod) >= RoleOperator
+}
+
+// Whether the caller may control the device. Always true when authorization is disabled.
+func controllingCaller(ctx context.Context) bool {
+	return authorize(ctx, RoleOperator) == nil
+}
+
+func (d *DeadManSwitch) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if controlMethod(info.FullMethod) && controllingCaller(ctx) {
+			d.Heartbeat()
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (d *DeadManSwitch) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isPublicMethod(info.FullMethod) || !controllingCaller(ss.Context()) {
+			return handler(srv, ss)
+		}
+		d.StreamOpened()
+		defer d.StreamClosed()
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,119 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDeadMan(timeout time.Duration) (*DeadManSwitch, chan time.Duration) {
+	trips := make(chan time.Duration, 10)
+	d := NewDeadManSwitch(timeout, func(idle time.Duration) { trips <- idle })
+	d.Start()
+	return d, trips
+}
+
+func TestDeadMan_Trips(t *testing.T) {
+	d, trips := newTestDeadMan(200 * time.Millisecond)
+	defer d.Stop()
+
+	select {
+	case idle := <-trips:
+		if idle < 200*time.Millisecond {
+			t.Fatalf("Tripped after %s, before the timeout", idle)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dead-man switch did not trip")
+	}
+}
+
+func TestDeadMan_HeartbeatResets(t *testing.T) {
+	d, trips := newTestDeadMan(300 * time.Millisecond)
+	defer d.Stop()
+
+	for i := 0; i < 12; i++ {
+		d.Heartbeat()
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-trips:
+		t.Fatal("Tripped although heartbeats kept coming")
+	default:
+	}
+
+	// an open stream keeps it satisfied too
+	d.StreamOpened()
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case <-trips:
+		t.Fatal("Tripped while a stream was open")
+	default:
+	}
+	d.StreamClosed()
+
+	select {
+	case <-trips:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dead-man switch did not trip after the heartbeats stopped")
+	}
+}
+
+func TestDeadMan_OnlyOperatorsCount(t *testing.T) {
+	d := NewDeadManSwitch(time.Hour, func(time.Duration) {})
+	reader := context.WithValue(context.Background(), principalKey{}, Principal{Name: "dashboard", Role: RoleRead})
+	operator := context.WithValue(context.Background(), principalKey{}, Principal{Name: "op", Role: RoleOperator})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	interceptor := d.UnaryServerInterceptor()
+
+	calls := []struct {
+		ctx    context.Context
+		method string
+		counts bool
+	}{
+		{reader, "/mvpulse.MicroVisionPulseService/GetPower", false},
+		{operator, "/mvpulse.MicroVisionPulseService/GetPower", false},
+		{operator, "/mvpulse.MicroVisionPulseService/SetPower", true},
+		{context.Background(), "/mvpulse.MicroVisionPulseService/SetPulseParam", true},
+		{operator, "/grpc.health.v1.Health/Check", false},
+	}
+	for _, call := range calls {
+		d.lastSeen = time.Time{}
+		_, _ = interceptor(call.ctx, nil, &grpc.UnaryServerInfo{FullMethod: call.method}, handler)
+		if counted := !d.lastSeen.IsZero(); counted != call.counts {
+			t.Errorf("%s: heartbeat %t, expected %t", call.method, counted, call.counts)
+		}
+	}
+
+	if controllingCaller(reader) || !controllingCaller(operator) {
+		t.Error("Only operators may keep the switch satisfied with a stream")
+	}
+}
+
+func TestDeadMan_ReasonInStatus(t *testing.T) {
+	config := DefaultConfig()
+	config.Simulate = 1
+	s := NewPulseSericeWithConfig(config)
+	ctx := context.Background()
+	_, err := s.Connect(ctx, &mvpulse.ConnectReq{DeviceIdentifier: &mvpulse.ConnectReq_Name{Name: "simulated-pulse-0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect(ctx, &mvpulse.DisconnectReq{})
+	_, err = s.SetPower(ctx, &mvpulse.SetPowerReq{Power: &mvpulse.PowerConfiguration{MasterPower: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.deadManTripped(time.Minute)
+
+	message := s.State.ParameterStream()
+	if message.Power == nil || message.Power.MasterPower {
+		t.Fatalf("Expected the power off but got %+v", message.Power)
+	}
+	if !strings.Contains(message.PowerOffReason, "dead-man") {
+		t.Fatalf("Expected the dead-man reason in the status but got %q", message.PowerOffReason)
+	}
+}
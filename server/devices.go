@@ -0,0 +1,109 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/wuyuanyi135/mvcamctrl/serial"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	goserial "go.bug.st/serial.v1"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How long a probed port has to answer the version command.
+const DefaultProbeTimeout = 200 * time.Millisecond
+
+// Lists the devices that can be opened: the serial ports of the host, or the virtual controllers when simulating.
+type deviceLister interface {
+	ListDevices() ([]serial.Device, error)
+	FindDevice(name string) (device serial.Device, ok bool, err error)
+}
+
+func (s *PulseSerice) devices() deviceLister {
+	if s.simulation != nil {
+		return s.simulation
+	}
+	return s.discovery
+}
+
+// The path a device is listed and recorded under: symlinks such as /dev/serial/by-id/... are resolved, so that the
+// opened device compares equal to its listed port. Paths that cannot be resolved, such as those of the virtual
+// controllers, are kept.
+func resolvePath(path string) string {
+	if path == "" {
+		return path
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return real
+}
+
+// Open the device at path, which is a virtual controller when simulating. The caller holds portMutex.
+func (s *PulseSerice) openDevice(path string) error {
+	if s.simulation == nil {
+		return s.serialInstance.ConnectByPath(path)
+	}
+	port, err := s.simulation.Open(path)
+	if err != nil {
+		return err
+	}
+	return s.serialInstance.ConnectPortAs(port, path)
+}
+
+// Ask every device for its version to tell pulse controllers from other serial devices. The ports are probed in
+// parallel. The opened device is asked through the open connection; ports that another process holds are left alone.
+func (s *PulseSerice) probeDevices(ctx context.Context, devices []*mvpulse.SerialDevice, timeout time.Duration) {
+	s.portMutex.Lock()
+	defer s.portMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(device *mvpulse.SerialDevice) {
+			defer wg.Done()
+			s.probeDevice(ctx, device, timeout)
+		}(device)
+	}
+	wg.Wait()
+}
+
+func (s *PulseSerice) probeDevice(ctx context.Context, device *mvpulse.SerialDevice, timeout time.Duration) {
+	var result serial.ProbeResult
+	var err error
+	switch {
+	case device.Opened:
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		var version []byte
+		version, err = s.deviceRequest(ctx, serial.SerialCommand{
+			Command: command.CommandVersion,
+		})
+		if err == nil {
+			result = serial.ProbeResult{HardwareVersion: version[0], FirmwareVersion: version[1]}
+		}
+	case s.simulation != nil:
+		var port goserial.Port
+		port, err = s.simulation.Open(device.Path)
+		if err == nil {
+			result, err = serial.ProbePort(port, device.Path, s.serialConfig, timeout)
+		}
+	case serial.PortInUse(device.Path):
+		device.ProbeError = "in use by another process"
+		return
+	default:
+		result, err = serial.Probe(device.Path, s.serialConfig, timeout)
+	}
+
+	device.Probed = true
+	if err != nil {
+		device.ProbeError = err.Error()
+		s.logger(ctx).Debugf("Probe of %s failed: %s", device.Path, err.Error())
+		return
+	}
+	device.PulseController = true
+	device.HardwareVersion = uint32(result.HardwareVersion)
+	device.FirmwareVersion = uint32(result.FirmwareVersion)
+}
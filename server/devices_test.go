@@ -0,0 +1,43 @@
+package mvcamctrl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvpulse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := filepath.Join(dir, "ttyUSB0")
+	err = ioutil.WriteFile(port, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "usb-MicroVision_Pulse-if00")
+	err = os.Symlink(port, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := map[string]string{
+		link:                       port,
+		port:                       port,
+		"sim://pulse0":             "sim://pulse0",
+		filepath.Join(dir, "gone"): filepath.Join(dir, "gone"),
+	}
+	for path, expected := range paths {
+		if resolved := resolvePath(path); resolved != expected {
+			t.Errorf("%s resolved to %s, expected %s", path, resolved, expected)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package mvcamctrl
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	gatewayPrefix = "/api/"
+	// time a client has to send the request headers
+	gatewayReadHeaderTimeout = 10 * time.Second
+	// largest request body read; every request message is far smaller
+	gatewayMaxBodySize = 1 << 20
+)
+
+type gatewayMethod struct {
+	newRequest func() proto.Message
+	call       func(ctx context.Context, req proto.Message) (proto.Message, error)
+}
+
+// Gateway exposes the pulse service as HTTP/JSON. Every RPC is served at POST /api/<RPC name> with the request message
+// as the JSON body and the response message as the JSON reply, using the proto JSON mapping. Calls must be POST with
+// Content-Type application/json, so that a foreign page cannot send them as a simple cross-site request.
+// ParameterStreaming updates are sent as Server-Sent Events from GET /api/ParameterStreaming, which alone accepts the
+// token as an access_token query parameter because browsers cannot set headers on an EventSource. Calls go through
+// the same authorization and dead-man heartbeat as gRPC. The web control panel is served at /.
+type Gateway struct {
+	service   *PulseSerice
+	auth      *AuthOptions
+	methods   map[string]gatewayMethod
+	marshaler jsonpb.Marshaler
+	mux       *http.ServeMux
+}
+
+func NewGateway(service *PulseSerice, auth *AuthOptions) *Gateway {
+	g := &Gateway{
+		service:   service,
+		auth:      auth,
+		methods:   gatewayMethods(service),
+		marshaler: jsonpb.Marshaler{EmitDefaults: true},
+		mux:       http.NewServeMux(),
+	}
+	g.mux.HandleFunc(gatewayPrefix+"ParameterStreaming", g.serveEvents)
+	g.mux.HandleFunc(gatewayPrefix, g.serveUnary)
+	g.mux.HandleFunc("/", serveWebUI)
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+func gatewayMethods(s *PulseSerice) map[string]gatewayMethod {
+	return map[string]gatewayMethod{
+		"GetDevices": {
+			func() proto.Message { return &mvpulse.GetDevicesReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.GetDevices(ctx, req.(*mvpulse.GetDevicesReq))
+			},
+		},
+		"DriverVersion": {
+			func() proto.Message { return &mvpulse.DriverVersionReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.DriverVersion(ctx, req.(*mvpulse.DriverVersionReq))
+			},
+		},
+		"Connect": {
+			func() proto.Message { return &mvpulse.ConnectReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.Connect(ctx, req.(*mvpulse.ConnectReq))
+			},
+		},
+		"Disconnect": {
+			func() proto.Message { return &mvpulse.DisconnectReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.Disconnect(ctx, req.(*mvpulse.DisconnectReq))
+			},
+		},
+		"DeviceVersion": {
+			func() proto.Message { return &mvpulse.DeviceVersionReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.DeviceVersion(ctx, req.(*mvpulse.DeviceVersionReq))
+			},
+		},
+		"SetPower": {
+			func() proto.Message { return &mvpulse.SetPowerReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.SetPower(ctx, req.(*mvpulse.SetPowerReq))
+			},
+		},
+		"GetPower": {
+			func() proto.Message { return &mvpulse.GetPowerReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.GetPower(ctx, req.(*mvpulse.GetPowerReq))
+			},
+		},
+		"SetPulseParam": {
+			func() proto.Message { return &mvpulse.SetPulseParamReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.SetPulseParam(ctx, req.(*mvpulse.SetPulseParamReq))
+			},
+		},
+		"GetPulseParam": {
+			func() proto.Message { return &mvpulse.GetPulseParamReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.GetPulseParam(ctx, req.(*mvpulse.GetPulseParamReq))
+			},
+		},
+		"CommitParameter": {
+			func() proto.Message { return &mvpulse.CommitParameterReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.CommitParameter(ctx, req.(*mvpulse.CommitParameterReq))
+			},
+		},
+		"SetTriggerArm": {
+			func() proto.Message { return &mvpulse.SetTriggerArmReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.SetTriggerArm(ctx, req.(*mvpulse.SetTriggerArmReq))
+			},
+		},
+		"GetTriggerArm": {
+			func() proto.Message { return &mvpulse.GetTriggerArmReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.GetTriggerArm(ctx, req.(*mvpulse.GetTriggerArmReq))
+			},
+		},
+		"Reset": {
+			func() proto.Message { return &mvpulse.ResetReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.Reset(ctx, req.(*mvpulse.ResetReq))
+			},
+		},
+		"Opened": {
+			func() proto.Message { return &mvpulse.OpenedReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.Opened(ctx, req.(*mvpulse.OpenedReq))
+			},
+		},
+		"GetAuditLog": {
+			func() proto.Message { return &mvpulse.GetAuditLogReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.GetAuditLog(ctx, req.(*mvpulse.GetAuditLogReq))
+			},
+		},
+		"GetHistory": {
+			func() proto.Message { return &mvpulse.GetHistoryReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.GetHistory(ctx, req.(*mvpulse.GetHistoryReq))
+			},
+		},
+		"SetLogLevel": {
+			func() proto.Message { return &mvpulse.SetLogLevelReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.SetLogLevel(ctx, req.(*mvpulse.SetLogLevelReq))
+			},
+		},
+		"AcquireLease": {
+			func() proto.Message { return &mvpulse.AcquireLeaseReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.AcquireLease(ctx, req.(*mvpulse.AcquireLeaseReq))
+			},
+		},
+		"RenewLease": {
+			func() proto.Message { return &mvpulse.RenewLeaseReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.RenewLease(ctx, req.(*mvpulse.RenewLeaseReq))
+			},
+		},
+		"ReleaseLease": {
+			func() proto.Message { return &mvpulse.ReleaseLeaseReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.ReleaseLease(ctx, req.(*mvpulse.ReleaseLeaseReq))
+			},
+		},
+		"RawCommand": {
+			func() proto.Message { return &mvpulse.RawCommandReq{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return s.RawCommand(ctx, req.(*mvpulse.RawCommandReq))
+			},
+		},
+	}
+}
+
+// Build the call context the gRPC interceptors would see: peer address, client certificate, bearer token. Then
+// authenticate and authorize the method. queryToken also takes the token from the URL.
+func (g *Gateway) callContext(r *http.Request, method string, queryToken bool) (context.Context, error) {
+	ctx := withRequestID(r.Context(), r.Header.Get(requestIDKey))
+
+	p := &peer.Peer{}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		p.Addr = addr
+	}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	ctx = peer.NewContext(ctx, p)
+
+	authorization := r.Header.Get("Authorization")
+	if token := r.URL.Query().Get("access_token"); queryToken && authorization == "" && token != "" {
+		authorization = "Bearer " + token
+	}
+	md := metadata.MD{}
+	if authorization != "" {
+		md.Set("authorization", authorization)
+	}
+	if lease := r.Header.Get(leaseIDKey); lease != "" {
+		md.Set(leaseIDKey, lease)
+	}
+	if len(md) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+
+	if g.auth == nil {
+		return ctx, nil
+	}
+	return g.auth.authorizeMethod(ctx, gatewayPrefix+method)
+}
+
+func (g *Gateway) serveUnary(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, gatewayPrefix)
+	method, ok := g.methods[name]
+	if !ok {
+		g.writeError(w, status.Errorf(codes.Unimplemented, "unknown method %s", name))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx, err := g.callContext(r, name, false)
+	if err != nil {
+		g.writeError(w, err)
+		return
+	}
+	w.Header().Set(requestIDKey, requestID(ctx))
+	if controlMethod(name) && controllingCaller(ctx) {
+		g.service.DeadMan.Heartbeat()
+	}
+
+	req := method.newRequest()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, gatewayMaxBodySize))
+	if err != nil {
+		g.writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		err = jsonpb.UnmarshalString(string(body), req)
+		if err != nil {
+			g.writeError(w, status.Errorf(codes.InvalidArgument, "invalid %s request: %s", name, err.Error()))
+			return
+		}
+	}
+
+	ctx, span := startCallSpan(ctx, gatewayPrefix+name, propagation.HeaderCarrier(r.Header))
+	resp, err := method.call(ctx, req)
+	endCallSpan(span, err)
+	if err != nil {
+		g.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = g.marshaler.Marshal(w, resp)
+	if err != nil {
+		log.Errorf("Failed to write %s response: %s", name, err.Error())
+	}
+}
+
+// Send the current state and then every change as a Server-Sent Event until the client goes away.
+func (g *Gateway) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, err := g.callContext(r, "ParameterStreaming", true)
+	if err != nil {
+		g.writeError(w, err)
+		return
+	}
+	if controllingCaller(ctx) {
+		g.service.DeadMan.StreamOpened()
+		defer g.service.DeadMan.StreamClosed()
+	}
+
+	statusChan := g.service.State.NotifyChanged.On("status")
+	parameterChan := g.service.State.NotifyChanged.On("parameter")
+	defer g.service.State.NotifyChanged.Off("status", statusChan)
+	defer g.service.State.NotifyChanged.Off("parameter", parameterChan)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for {
+		state := g.service.State.ParameterStream()
+		message, err := g.marshaler.MarshalToString(state)
+		if err != nil {
+			log.Errorf("Failed to encode stream message: %s", err.Error())
+			return
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", state.Revision, message)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-g.service.shutdown:
+			return
+		case <-statusChan:
+		case <-parameterChan:
+		}
+	}
+}
+
+func (g *Gateway) writeError(w http.ResponseWriter, err error) {
+	st, _ := status.FromError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	_ = g.marshaler.Marshal(w, st.Proto())
+}
+
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound, codes.Unimplemented:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
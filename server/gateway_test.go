@@ -0,0 +1,139 @@
+package mvcamctrl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestGateway(auth *AuthOptions) *httptest.Server {
+	return httptest.NewServer(NewGateway(NewPulseSerice(), auth))
+}
+
+func TestGateway_RejectsSimpleRequests(t *testing.T) {
+	server := newTestGateway(nil)
+	defer server.Close()
+
+	requests := []struct {
+		method      string
+		contentType string
+		body        string
+		code        int
+	}{
+		{http.MethodGet, "", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "text/plain", "{}", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "application/x-www-form-urlencoded", "a=b", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", "{}", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "application/json; charset=utf-8", "{}", http.StatusOK},
+	}
+	for _, request := range requests {
+		req, err := http.NewRequest(request.method, server.URL+"/api/DriverVersion", strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request.contentType != "" {
+			req.Header.Set("Content-Type", request.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != request.code {
+			t.Errorf("%s %q: got %d, expected %d", request.method, request.contentType, resp.StatusCode, request.code)
+		}
+	}
+}
+
+func TestGateway_MissingArgument(t *testing.T) {
+	server := newTestGateway(nil)
+	defer server.Close()
+
+	for _, method := range []string{"SetPower", "SetPulseParam"} {
+		resp, err := http.Post(server.URL+"/api/"+method, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s without an argument: got %d, expected %d", method, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGateway_QueryTokenOnlyForEvents(t *testing.T) {
+	server := newTestGateway(&AuthOptions{
+		Tokens: map[string]TokenGrant{"secret": {Name: "dashboard", Role: RoleRead}},
+	})
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/DriverVersion?access_token=secret", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Unary call with a query token: got %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/DriverVersion", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unary call with a bearer token: got %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err = http.NewRequest(http.MethodGet, server.URL+"/api/ParameterStreaming?access_token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Event stream with a query token: got %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Event stream sent %q", contentType)
+	}
+}
+
+func TestGateway_Errors(t *testing.T) {
+	server := newTestGateway(nil)
+	defer server.Close()
+
+	requests := []struct {
+		method string
+		body   string
+		code   int
+	}{
+		// the device is not opened
+		{"CommitParameter", "{}", http.StatusPreconditionFailed},
+		// valid, but larger than any request should be
+		{"DriverVersion", "{}" + strings.Repeat(" ", gatewayMaxBodySize), http.StatusBadRequest},
+	}
+	for _, request := range requests {
+		resp, err := http.Post(server.URL+"/api/"+request.method, "application/json", strings.NewReader(request.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != request.code {
+			t.Errorf("%s: got %d, expected %d", request.method, resp.StatusCode, request.code)
+		}
+	}
+}
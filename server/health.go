@@ -0,0 +1,246 @@
+package mvcamctrl
+
+import (
+	"context"
+	"fmt"
+	"github.com/wuyuanyi135/mvcamctrl/history"
+	"github.com/wuyuanyi135/mvcamctrl/serial"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHealthProbeInterval = 5 * time.Second
+	DefaultHeartbeatFailures   = 3
+	healthProbeTimeout         = time.Second
+	dtrResetDuration           = 100 * time.Millisecond
+
+	RecoveryNone      = ""
+	RecoveryReconnect = "reconnect"
+	RecoveryDTR       = "dtr"
+)
+
+type HeartbeatOptions struct {
+	// Time between two heartbeats.
+	Interval time.Duration
+	// Missed heartbeats in a row before the device is marked as not responding.
+	Failures int
+	// RecoveryNone, RecoveryReconnect or RecoveryDTR. Attempted after every missed heartbeat while the device is not
+	// responding. A device that cannot be reopened is closed.
+	Recovery string
+}
+
+// HealthReporter sends a heartbeat (the version command) to the opened device and publishes the standard
+// grpc.health.v1 status. When the device misses Failures heartbeats in a row it is marked as not responding in the
+// state, and the configured recovery is attempted until it answers again. The overall status and the pulse service
+// are SERVING only while a device is open and responding.
+type HealthReporter struct {
+	server  *health.Server
+	service *PulseSerice
+	names   []string
+	options HeartbeatOptions
+
+	// heartbeats missed in a row and the device they were sent to; only touched by run
+	failures int
+	device   string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewHealthReporter(grpcServer *grpc.Server, service *PulseSerice, options HeartbeatOptions) (*HealthReporter, error) {
+	switch options.Recovery {
+	case RecoveryNone, RecoveryReconnect, RecoveryDTR:
+	default:
+		return nil, fmt.Errorf("unknown heartbeat recovery %q", options.Recovery)
+	}
+	if options.Interval <= 0 {
+		return nil, fmt.Errorf("heartbeat interval must be positive, not %s", options.Interval)
+	}
+	if options.Failures < 1 {
+		options.Failures = 1
+	}
+
+	h := &HealthReporter{
+		server:  health.NewServer(),
+		service: service,
+		names:   []string{""},
+		options: options,
+		stop:    make(chan struct{}),
+	}
+
+	for name := range grpcServer.GetServiceInfo() {
+		if strings.HasSuffix(name, "MicroVisionPulseService") {
+			h.names = append(h.names, name)
+		}
+	}
+	h.set(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	grpc_health_v1.RegisterHealthServer(grpcServer, h.server)
+	return h, nil
+}
+
+func (h *HealthReporter) Start() {
+	go h.run()
+}
+
+// Report NOT_SERVING for every service and stop probing.
+func (h *HealthReporter) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+		h.server.Shutdown()
+	})
+}
+
+func (h *HealthReporter) run() {
+	ticker := time.NewTicker(h.options.Interval)
+	defer ticker.Stop()
+
+	statusChan := h.service.State.NotifyChanged.On("status")
+	parameterChan := h.service.State.NotifyChanged.On("parameter")
+	defer h.service.State.NotifyChanged.Off("status", statusChan)
+	defer h.service.State.NotifyChanged.Off("parameter", parameterChan)
+
+	h.beat()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.beat()
+		case <-statusChan:
+			h.refresh()
+		case <-parameterChan:
+			h.refresh()
+		}
+	}
+}
+
+// Follow the opened device: a newly opened device gets a heartbeat right away, so that the health status does not
+// wait for the next tick.
+func (h *HealthReporter) refresh() {
+	state := h.service.State.Snapshot()
+	if !state.Opened {
+		h.failures = 0
+		h.device = ""
+		h.set(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+		return
+	}
+	if state.OpenedDevice.Path != h.device {
+		h.beat()
+	}
+}
+
+func (h *HealthReporter) beat() {
+	state := h.service.State.Snapshot()
+	if !state.Opened {
+		h.set(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+		return
+	}
+	if state.OpenedDevice.Path != h.device {
+		h.failures = 0
+		h.device = state.OpenedDevice.Path
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthProbeTimeout)
+	defer cancel()
+	_, err := h.service.deviceRequest(ctx, serial.SerialCommand{
+		Command: command.CommandVersion,
+	})
+	if err == nil {
+		h.failures = 0
+		if state.NotResponding {
+			h.responding()
+		}
+		h.set(grpc_health_v1.HealthCheckResponse_SERVING)
+		return
+	}
+
+	h.failures++
+	log.Warningf("Heartbeat %d of %d failed: %s", h.failures, h.options.Failures, err.Error())
+	if h.failures < h.options.Failures {
+		return
+	}
+
+	h.set(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	if !state.NotResponding {
+		state = h.service.State.Update("status", func(next *StateSnapshot) {
+			next.NotResponding = true
+		})
+		log.Errorf("Device %s is not responding", h.device)
+		h.service.event(history.Watchdog, state.Revision, "not responding after %d missed heartbeats", h.failures)
+	}
+	h.recover()
+}
+
+// The device answers again. It may have been reset, so its state is read again.
+func (h *HealthReporter) responding() {
+	state := h.service.State.Update("status", func(next *StateSnapshot) {
+		next.NotResponding = false
+	})
+	log.Noticef("Device %s is responding again", h.device)
+	h.service.event(history.Watchdog, state.Revision, "responding again")
+
+	err := h.service.syncState(context.Background())
+	if err != nil {
+		log.Warningf("Failed to read the state of %s: %s", h.device, err.Error())
+	}
+}
+
+func (h *HealthReporter) recover() {
+	if h.options.Recovery == RecoveryNone {
+		return
+	}
+
+	s := h.service
+	s.portMutex.Lock()
+	defer s.portMutex.Unlock()
+	// the device may have been closed or replaced since the heartbeat
+	state := s.State.Snapshot()
+	if !state.Opened || state.OpenedDevice.Path != h.device {
+		return
+	}
+
+	var err error
+	switch h.options.Recovery {
+	case RecoveryReconnect:
+		err = s.serialInstance.Disconnect()
+		if err != nil {
+			break
+		}
+		err = s.openDevice(h.device)
+		if err != nil {
+			// the port is closed now; report it instead of a device that looks open
+			log.Errorf("Failed to reopen %s: %s", h.device, err.Error())
+			s.event(history.Disconnect, 0, "closed, reopening failed: %s", err.Error())
+			s.State.SetClosed()
+			return
+		}
+	case RecoveryDTR:
+		err = s.serialInstance.ToggleDTR(dtrResetDuration)
+	}
+	if err != nil {
+		log.Errorf("Recovery of %s by %s failed: %s", h.device, h.options.Recovery, err.Error())
+		s.event(history.Watchdog, 0, "%s failed: %s", h.options.Recovery, err.Error())
+		return
+	}
+	log.Noticef("Attempted recovery of %s by %s", h.device, h.options.Recovery)
+	s.event(history.Watchdog, 0, "attempted %s", h.options.Recovery)
+}
+
+func (h *HealthReporter) set(status grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	select {
+	case <-h.stop:
+		// keep the shutdown status
+		return
+	default:
+	}
+	for _, name := range h.names {
+		h.server.SetServingStatus(name, status)
+	}
+}
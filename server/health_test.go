@@ -0,0 +1,88 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/wuyuanyi135/mvcamctrl/serial/simulator"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"testing"
+	"time"
+)
+
+func newTestHealthReporter(t *testing.T, options HeartbeatOptions) (*HealthReporter, *PulseSerice) {
+	config := DefaultConfig()
+	config.Simulate = 1
+	s := NewPulseSericeWithConfig(config)
+	_, err := s.Connect(context.Background(), &mvpulse.ConnectReq{
+		DeviceIdentifier: &mvpulse.ConnectReq_Name{Name: "simulated-pulse-0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHealthReporter(grpc.NewServer(), s, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, s
+}
+
+func checkServing(t *testing.T, h *HealthReporter, expected grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	resp, err := h.server.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != expected {
+		t.Fatalf("Health status %s, expected %s", resp.Status, expected)
+	}
+}
+
+func TestHealthReporter_InvalidOptions(t *testing.T) {
+	for _, options := range []HeartbeatOptions{
+		{Interval: 0},
+		{Interval: -time.Second},
+		{Interval: time.Second, Recovery: "reboot"},
+	} {
+		_, err := NewHealthReporter(grpc.NewServer(), NewPulseSerice(), options)
+		if err == nil {
+			t.Errorf("Options %+v were accepted", options)
+		}
+	}
+}
+
+func TestHealthReporter_NotResponding(t *testing.T) {
+	h, s := newTestHealthReporter(t, HeartbeatOptions{Interval: time.Hour, Failures: 2})
+	defer s.Disconnect(context.Background(), &mvpulse.DisconnectReq{})
+
+	h.beat()
+	checkServing(t, h, grpc_health_v1.HealthCheckResponse_SERVING)
+
+	// the device goes away behind the open state
+	_ = s.serialInstance.Disconnect()
+	h.beat()
+	if s.State.Snapshot().NotResponding {
+		t.Fatal("Marked as not responding after the first missed heartbeat")
+	}
+	h.beat()
+	checkServing(t, h, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	state := s.State.Snapshot()
+	if !state.NotResponding || !state.Opened {
+		t.Fatalf("Expected an open device that does not respond but got opened %t, not responding %t",
+			state.Opened, state.NotResponding)
+	}
+}
+
+// A device that cannot be reopened is reported closed rather than open.
+func TestHealthReporter_ReconnectFailureCloses(t *testing.T) {
+	h, s := newTestHealthReporter(t, HeartbeatOptions{Interval: time.Hour, Failures: 1, Recovery: RecoveryReconnect})
+
+	h.beat()
+	_ = s.serialInstance.Disconnect()
+	s.simulation = simulator.NewBench(0)
+	h.beat()
+
+	checkServing(t, h, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	if state := s.State.Snapshot(); state.Opened || state.OpenedDevice != nil {
+		t.Fatalf("Expected the device closed after the failed reconnect but got %+v", state.OpenedDevice)
+	}
+}
@@ -0,0 +1,93 @@
+package mvcamctrl
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/wuyuanyi135/mvcamctrl/history"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"strings"
+)
+
+// Record a device event in the history. revision is the state revision after the event, zero if it did not change
+// the state.
+func (s *PulseSerice) event(eventType string, revision uint64, format string, args ...interface{}) {
+	device := ""
+	if opened := s.State.Snapshot().OpenedDevice; opened != nil {
+		device = opened.Name
+	}
+
+	err := s.History.Record(history.Event{
+		Type:     eventType,
+		Device:   device,
+		Message:  fmt.Sprintf(format, args...),
+		Revision: revision,
+	})
+	if err != nil {
+		log.Errorf("Failed to record %s event: %s", eventType, err.Error())
+	}
+}
+
+func (s *PulseSerice) GetHistory(ctx context.Context, req *mvpulse.GetHistoryReq) (resp *mvpulse.GetHistoryRes, err error) {
+	resp = &mvpulse.GetHistoryRes{}
+
+	filter := history.Filter{
+		Types: req.Types,
+		Limit: int(req.Limit),
+	}
+	if req.Since != nil {
+		filter.Since, err = ptypes.Timestamp(req.Since)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if req.Until != nil {
+		filter.Until, err = ptypes.Timestamp(req.Until)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, event := range s.History.Query(filter) {
+		timestamp, err := ptypes.TimestampProto(event.Time)
+		if err != nil {
+			return nil, err
+		}
+		resp.Events = append(resp.Events, &mvpulse.HistoryEvent{
+			Sequence: event.Sequence,
+			Time:     timestamp,
+			Type:     event.Type,
+			Device:   event.Device,
+			Message:  event.Message,
+			Revision: event.Revision,
+		})
+	}
+	return
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func pulseText(config *mvpulse.PulseConfiguration) string {
+	if config == nil {
+		return "unknown"
+	}
+	var fields []string
+	if config.ExposureTick != nil {
+		fields = append(fields, fmt.Sprintf("exposure=%d", config.ExposureTick.Value))
+	}
+	if config.PulseDelay != nil {
+		fields = append(fields, fmt.Sprintf("delay=%d", config.PulseDelay.Value))
+	}
+	if config.DigitalFilter != nil {
+		fields = append(fields, fmt.Sprintf("filter=%d", config.DigitalFilter.Value))
+	}
+	if config.Polarity != nil {
+		fields = append(fields, fmt.Sprintf("inverted=%t", config.Polarity.Value))
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,52 @@
+package mvcamctrl
+
+import (
+	"context"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Address of the client that issued the call, if known.
+func callerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+// Authenticated identity of the client that issued the call. Empty when the client is anonymous.
+func callerIdentity(ctx context.Context) string {
+	if principal, ok := PrincipalFromContext(ctx); ok && principal.Name != "" {
+		return principal.Name
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return ""
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	// only certificates that passed verification identify a client
+	certificate := tlsInfo.State.VerifiedChains[0][0]
+	if certificate.Subject.CommonName != "" {
+		return certificate.Subject.CommonName
+	}
+	if len(certificate.EmailAddresses) > 0 {
+		return certificate.EmailAddresses[0]
+	}
+	if len(certificate.DNSNames) > 0 {
+		return certificate.DNSNames[0]
+	}
+	return ""
+}
+
+// Identity of the caller as made available to interceptors and handlers: the peer address, followed by the
+// authenticated identity when there is one.
+func CallerIdentity(ctx context.Context) (address string, identity string) {
+	return callerAddress(ctx), callerIdentity(ctx)
+}
@@ -0,0 +1,246 @@
+package mvcamctrl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/wuyuanyi135/mvcamctrl/history"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// Holders send their lease ID in this metadata key (or HTTP header) with every control call.
+const leaseIDKey = "x-lease-id"
+
+const (
+	DefaultLeaseTTL = 30 * time.Second
+	MaxLeaseTTL     = 10 * time.Minute
+)
+
+// Lease gives one client exclusive control of the device until it expires. The ID and the holder are fixed; renewing
+// moves the expiry of the same lease, which is not a change of the state.
+type Lease struct {
+	ID     string
+	Holder string
+
+	mutex   sync.Mutex
+	expires time.Time
+}
+
+func newLease(id string, holder string, ttl time.Duration) *Lease {
+	return &Lease{
+		ID:      id,
+		Holder:  holder,
+		expires: time.Now().Add(ttl),
+	}
+}
+
+func (l *Lease) Expires() time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.expires
+}
+
+func (l *Lease) extend(ttl time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.expires = time.Now().Add(ttl)
+}
+
+func (l *Lease) expired() bool {
+	return !time.Now().Before(l.Expires())
+}
+
+// Message for clients. The ID is only given to the holder.
+func (l *Lease) proto(withID bool) *mvpulse.Lease {
+	if l == nil {
+		return nil
+	}
+	expires, _ := ptypes.TimestampProto(l.Expires())
+	message := &mvpulse.Lease{
+		Holder:  l.Holder,
+		Expires: expires,
+	}
+	if withID {
+		message.Id = l.ID
+	}
+	return message
+}
+
+func leaseTTL(ms uint32) (time.Duration, error) {
+	if ms == 0 {
+		return DefaultLeaseTTL, nil
+	}
+	ttl := time.Duration(ms) * time.Millisecond
+	if ttl > MaxLeaseTTL {
+		return 0, status.Errorf(codes.InvalidArgument, "lease TTL is limited to %s", MaxLeaseTTL)
+	}
+	return ttl, nil
+}
+
+func leaseIDFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(leaseIDKey)) == 0 {
+		return ""
+	}
+	return md.Get(leaseIDKey)[0]
+}
+
+// Name the lease holder is shown with: the owner given by the client, the authenticated identity and the address.
+func leaseHolder(ctx context.Context, owner string) string {
+	holder := callerIdentity(ctx)
+	if holder == "" {
+		holder = callerAddress(ctx)
+	}
+	if holder == "" {
+		holder = "anonymous"
+	}
+	if owner != "" {
+		holder = fmt.Sprintf("%s (%s)", owner, holder)
+	}
+	return holder
+}
+
+// The current lease, or nil when nobody holds one.
+func (s *PulseSerice) currentLease() *Lease {
+	state := s.State.Snapshot()
+	return state.liveLease()
+}
+
+// Fail unless nobody holds the lease or the caller sent the ID of the current one.
+func (s *PulseSerice) leaseGuard(ctx context.Context) error {
+	lease := s.currentLease()
+	if lease == nil || leaseIDFromContext(ctx) == lease.ID {
+		return nil
+	}
+	return status.Errorf(codes.FailedPrecondition, "the device is controlled by %s until %s",
+		lease.Holder, lease.Expires().Format(time.RFC3339))
+}
+
+// Store the lease, or clear it when lease is nil, and let it expire after its TTL. The caller holds leaseMutex.
+func (s *PulseSerice) setLease(lease *Lease) uint64 {
+	if s.leaseTimer != nil {
+		s.leaseTimer.Stop()
+		s.leaseTimer = nil
+	}
+	state := s.State.Update("status", func(next *StateSnapshot) {
+		next.Lease = lease
+	})
+	if lease != nil {
+		s.leaseTimer = time.AfterFunc(time.Until(lease.Expires()), func() { s.expireLease(lease) })
+	}
+	return state.Revision
+}
+
+func (s *PulseSerice) expireLease(lease *Lease) {
+	s.leaseMutex.Lock()
+	defer s.leaseMutex.Unlock()
+	// renewed, replaced or released in the meantime
+	if s.State.Snapshot().Lease != lease || !lease.expired() {
+		return
+	}
+	revision := s.setLease(nil)
+	log.Noticef("Lease of %s expired", lease.Holder)
+	s.event(history.Lease, revision, "lease of %s expired", lease.Holder)
+}
+
+// Take exclusive control of the device. Fails while another client holds the lease, unless an admin forces it.
+// Without authorization nobody is an admin, so the lease cannot be forced and the holder keeps it until it releases
+// it or lets it expire.
+func (s *PulseSerice) AcquireLease(ctx context.Context, req *mvpulse.AcquireLeaseReq) (resp *mvpulse.LeaseRes, err error) {
+	s.leaseMutex.Lock()
+	defer s.leaseMutex.Unlock()
+	current := s.currentLease()
+	defer func() { s.audit(ctx, "AcquireLease", current.proto(false), req, err) }()
+
+	ttl, err := leaseTTL(req.TtlMs)
+	if err != nil {
+		return
+	}
+	if current != nil && current.ID != leaseIDFromContext(ctx) {
+		if !req.Force {
+			return nil, status.Errorf(codes.FailedPrecondition, "the device is controlled by %s until %s",
+				current.Holder, current.Expires().Format(time.RFC3339))
+		}
+		if _, ok := PrincipalFromContext(ctx); !ok {
+			return nil, status.Error(codes.FailedPrecondition, "forcing a lease requires authorization to be enabled")
+		}
+		err = authorize(ctx, RoleAdmin)
+		if err != nil {
+			return
+		}
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create a lease ID: %s", err.Error())
+	}
+	lease := newLease(hex.EncodeToString(id), leaseHolder(ctx, req.Owner), ttl)
+	revision := s.setLease(lease)
+	if current != nil && current.ID != leaseIDFromContext(ctx) {
+		s.logger(ctx).Warningf("Lease of %s taken over by %s", current.Holder, lease.Holder)
+		s.event(history.Lease, revision, "lease taken from %s by %s", current.Holder, lease.Holder)
+	} else {
+		s.event(history.Lease, revision, "lease acquired by %s", lease.Holder)
+	}
+
+	resp = &mvpulse.LeaseRes{
+		Lease:    lease.proto(true),
+		Revision: revision,
+	}
+	return
+}
+
+// Extend the caller's lease by a new TTL from now. The state keeps its revision; the stream shows the new expiry with
+// the next change.
+func (s *PulseSerice) RenewLease(ctx context.Context, req *mvpulse.RenewLeaseReq) (resp *mvpulse.LeaseRes, err error) {
+	s.leaseMutex.Lock()
+	defer s.leaseMutex.Unlock()
+
+	ttl, err := leaseTTL(req.TtlMs)
+	if err != nil {
+		return
+	}
+	current := s.currentLease()
+	if current == nil || current.ID != req.LeaseId {
+		return nil, status.Error(codes.FailedPrecondition, "the lease has expired or was taken over")
+	}
+
+	current.extend(ttl)
+	s.leaseTimer.Reset(ttl)
+
+	resp = &mvpulse.LeaseRes{
+		Lease:    current.proto(true),
+		Revision: s.State.Snapshot().Revision,
+	}
+	return
+}
+
+// Give up control. Releasing a lease that has already expired succeeds.
+func (s *PulseSerice) ReleaseLease(ctx context.Context, req *mvpulse.ReleaseLeaseReq) (resp *mvpulse.ReleaseLeaseRes, err error) {
+	s.leaseMutex.Lock()
+	defer s.leaseMutex.Unlock()
+	current := s.currentLease()
+	defer func() { s.audit(ctx, "ReleaseLease", current.proto(false), nil, err) }()
+
+	resp = &mvpulse.ReleaseLeaseRes{}
+	if current == nil {
+		resp.Revision = s.State.Snapshot().Revision
+		return
+	}
+	if current.ID != req.LeaseId {
+		return nil, status.Errorf(codes.FailedPrecondition, "the lease is held by %s", current.Holder)
+	}
+
+	revision := s.setLease(nil)
+	s.event(history.Lease, revision, "lease released by %s", current.Holder)
+	resp.Revision = revision
+	return
+}
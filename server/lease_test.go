@@ -0,0 +1,124 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func withLease(ctx context.Context, id string) context.Context {
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(leaseIDKey, id))
+}
+
+func TestLease_Exclusive(t *testing.T) {
+	s := NewPulseSerice()
+	operator := context.WithValue(context.Background(), principalKey{}, Principal{Name: "op", Role: RoleOperator})
+	other := context.WithValue(context.Background(), principalKey{}, Principal{Name: "other", Role: RoleOperator})
+	admin := context.WithValue(context.Background(), principalKey{}, Principal{Name: "admin", Role: RoleAdmin})
+
+	if err := s.leaseGuard(other); err != nil {
+		t.Fatalf("guard without a lease: %v", err)
+	}
+
+	resp, err := s.AcquireLease(operator, &mvpulse.AcquireLeaseReq{Owner: "bench"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Lease.Id
+	if id == "" || resp.Lease.Holder != "bench (op)" {
+		t.Fatalf("unexpected lease %+v", resp.Lease)
+	}
+	if lease := s.State.ParameterStream().Lease; lease == nil || lease.Id != "" {
+		t.Fatalf("the stream must show the holder without the ID, got %+v", lease)
+	}
+
+	if err := s.leaseGuard(withLease(operator, id)); err != nil {
+		t.Fatalf("guard for the holder: %v", err)
+	}
+	if err := s.leaseGuard(other); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("guard for another client: %v", err)
+	}
+	if _, err := s.AcquireLease(other, &mvpulse.AcquireLeaseReq{}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("acquire of a held lease: %v", err)
+	}
+	if _, err := s.AcquireLease(other, &mvpulse.AcquireLeaseReq{Force: true}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("forced acquire by an operator: %v", err)
+	}
+
+	taken, err := s.AcquireLease(admin, &mvpulse.AcquireLeaseReq{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RenewLease(operator, &mvpulse.RenewLeaseReq{LeaseId: id}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("renew of a lease taken over: %v", err)
+	}
+	if _, err := s.ReleaseLease(admin, &mvpulse.ReleaseLeaseReq{LeaseId: taken.Lease.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if s.currentLease() != nil {
+		t.Fatal("lease still held after release")
+	}
+}
+
+func TestLease_Expires(t *testing.T) {
+	s := NewPulseSerice()
+	if _, err := s.AcquireLease(context.Background(), &mvpulse.AcquireLeaseReq{TtlMs: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.leaseGuard(context.Background()); err == nil {
+		t.Fatal("guard passed while another client holds the lease")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := s.leaseGuard(context.Background()); err != nil {
+		t.Fatalf("guard after expiry: %v", err)
+	}
+	if s.State.Snapshot().Lease != nil {
+		t.Fatal("expired lease was not cleared")
+	}
+}
+
+// Without authorization there is no admin who could take a lease over.
+func TestLease_ForceRequiresAuth(t *testing.T) {
+	s := NewPulseSerice()
+	ctx := context.Background()
+
+	_, err := s.AcquireLease(ctx, &mvpulse.AcquireLeaseReq{Owner: "bench"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AcquireLease(ctx, &mvpulse.AcquireLeaseReq{Force: true}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("forced acquire without authorization: %v", err)
+	}
+}
+
+// Renewing moves the expiry without a new revision, and the lease expires at the renewed time.
+func TestLease_Renew(t *testing.T) {
+	s := NewPulseSerice()
+	ctx := context.Background()
+	resp, err := s.AcquireLease(ctx, &mvpulse.AcquireLeaseReq{TtlMs: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision := s.State.Snapshot().Revision
+
+	if _, err := s.RenewLease(ctx, &mvpulse.RenewLeaseReq{LeaseId: resp.Lease.Id, TtlMs: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if s.State.Snapshot().Revision != revision {
+		t.Fatal("renewing the lease changed the revision")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if s.currentLease() == nil || s.State.Snapshot().Lease == nil {
+		t.Fatal("lease expired at its original time after renewing")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if s.State.Snapshot().Lease != nil {
+		t.Fatal("renewed lease was not cleared after it expired")
+	}
+}
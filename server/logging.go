@@ -0,0 +1,115 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/wuyuanyi135/mvcamctrl/logs"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Clients may pass their own request ID in this metadata key (or HTTP header) to correlate logs.
+const requestIDKey = "x-request-id"
+
+var requestSequence uint64
+
+type requestIDContextKey struct{}
+
+// Attach the request ID given by the client, or a new one.
+func withRequestID(ctx context.Context, given string) context.Context {
+	id := given
+	if id == "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(requestIDKey)) > 0 {
+			id = md.Get(requestIDKey)[0]
+		}
+	}
+	if id == "" {
+		id = strconv.FormatUint(atomic.AddUint64(&requestSequence, 1), 10)
+	}
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// Logger with the request ID, the peer and its identity, the opened device and the trace of the call.
+func (s *PulseSerice) logger(ctx context.Context) *logs.Logger {
+	device := ""
+	if opened := s.State.Snapshot().OpenedDevice; opened != nil {
+		device = opened.Name
+	}
+	traceID := ""
+	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
+		traceID = span.TraceID().String()
+	}
+	return log.With(logs.FieldRequestID, requestID(ctx), logs.FieldPeer, callerAddress(ctx),
+		logs.FieldIdentity, callerIdentity(ctx), logs.FieldDevice, device, logs.FieldTraceID, traceID)
+}
+
+// Assign request IDs and log every call with its duration and status at debug level.
+func (s *PulseSerice) LoggingUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx = withRequestID(ctx, "")
+		_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, requestID(ctx)))
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		s.logCall(ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+func (s *PulseSerice) LoggingStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = withRequestID(ss.Context(), "")
+		_ = ss.SetHeader(metadata.Pairs(requestIDKey, requestID(wrapped.WrappedContext)))
+
+		start := time.Now()
+		err := handler(srv, wrapped)
+		s.logCall(wrapped.WrappedContext, info.FullMethod, start, err)
+		return err
+	}
+}
+
+func (s *PulseSerice) logCall(ctx context.Context, method string, start time.Time, err error) {
+	if isPublicMethod(method) {
+		return
+	}
+	code := status.Code(err)
+	logger := s.logger(ctx).With("method", method, "code", code.String(), "duration", time.Since(start).String())
+	if code == codes.OK {
+		logger.Debugf("Call finished")
+	} else {
+		logger.Infof("Call failed: %s", status.Convert(err).Message())
+	}
+}
+
+// Change the level of a logging module, or the default level when the module is empty. An empty level only reports
+// the current levels.
+func (s *PulseSerice) SetLogLevel(ctx context.Context, req *mvpulse.SetLogLevelReq) (resp *mvpulse.SetLogLevelRes, err error) {
+	if req.Level != "" {
+		old := logs.Levels()[req.Module]
+		defer func() { s.audit(ctx, "SetLogLevel", old, req, err) }()
+
+		err = logs.SetLevel(req.Module, req.Level)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		s.logger(ctx).Noticef("Log level of %q set to %s", req.Module, req.Level)
+	}
+
+	resp = &mvpulse.SetLogLevelRes{
+		Levels: logs.Levels(),
+	}
+	return
+}
@@ -0,0 +1,326 @@
+package mvcamctrl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMQTTTopicPrefix = "mvpulse"
+	mqttTimeout            = 5 * time.Second
+	mqttQoS                = 1
+)
+
+// retained state topics below <prefix>/<device>
+var mqttStateTopics = []string{"opened", "not_responding", "armed", "power_off_reason", "power", "pulse"}
+
+// RPC each command topic maps to
+var mqttCommands = map[string]string{
+	"power":   "SetPower",
+	"pulse":   "SetPulseParam",
+	"trigger": "SetTriggerArm",
+}
+
+type MQTTConfig struct {
+	// Broker URL such as "tcp://localhost:1883".
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Topics are <prefix>/<device>/...
+	TopicPrefix string `json:"topic_prefix"`
+	// Role of the commands from the bridge. Defaults to read, which rejects the commands, when authorization is
+	// enabled and to operator otherwise.
+	Role *Role `json:"role"`
+}
+
+// MQTTBridge publishes the device state as retained JSON topics and maps command topics onto the service:
+//
+//	<prefix>/<device>/opened, not_responding, power, armed, pulse, power_off_reason   retained state
+//	<prefix>/<device>/command/power     SetPowerReq JSON, e.g. {"power": {"masterPower": false}}
+//	<prefix>/<device>/command/pulse     SetPulseParamReq JSON, e.g. {"pulse": {"exposureTick": 700}, "commit": true}
+//	<prefix>/<device>/command/trigger   SetTriggerArmReq JSON, e.g. {"armTrigger": true}
+//	<prefix>/<device>/result            outcome of each command
+//	<prefix>/online                     retained true while the bridge is connected, false otherwise
+//
+// <device> is the by-id name of the opened device. Commands run through the service methods, so they are checked
+// against the role of the bridge and the safety policy and audited like gRPC calls. The broker publishes online false
+// as the last will when the bridge drops off; the retained state is stale from then on. A clean stop also clears the
+// retained state topics.
+type MQTTBridge struct {
+	config    MQTTConfig
+	role      Role
+	service   *PulseSerice
+	client    mqtt.Client
+	marshaler jsonpb.Marshaler
+
+	mutex         sync.Mutex
+	publishedName string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type mqttResult struct {
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+func NewMQTTBridge(config MQTTConfig, service *PulseSerice, auth *AuthOptions) *MQTTBridge {
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = DefaultMQTTTopicPrefix
+	}
+	if config.ClientID == "" {
+		config.ClientID = "mvpulse-bridge"
+	}
+	role := RoleOperator
+	if auth != nil {
+		role = RoleRead
+	}
+	if config.Role != nil {
+		role = *config.Role
+	}
+
+	b := &MQTTBridge{
+		config:    config,
+		role:      role,
+		service:   service,
+		marshaler: jsonpb.Marshaler{EmitDefaults: true},
+		stop:      make(chan struct{}),
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetBinaryWill(config.TopicPrefix+"/online", []byte("false"), mqttQoS, true).
+		SetOnConnectHandler(b.onConnect)
+	b.client = mqtt.NewClient(options)
+	return b
+}
+
+func (b *MQTTBridge) Start() error {
+	token := b.client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timed out connecting to MQTT broker %s", b.config.Broker)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("failed to connect to MQTT broker %s: %s", b.config.Broker, token.Error().Error())
+	}
+	go b.run()
+	return nil
+}
+
+func (b *MQTTBridge) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+		if b.client.IsConnected() {
+			b.clearState()
+			b.publish("online", false, true)
+		}
+		b.client.Disconnect(uint(mqttTimeout / time.Millisecond))
+	})
+}
+
+// Subscribe again and refresh the retained state after every (re)connection.
+func (b *MQTTBridge) onConnect(client mqtt.Client) {
+	topic := b.config.TopicPrefix + "/+/command/+"
+	token := client.Subscribe(topic, mqttQoS, b.onCommand)
+	if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+		log.Errorf("Failed to subscribe to %s: %s", topic, token.Error().Error())
+	}
+	log.Infof("MQTT bridge connected to %s", b.config.Broker)
+	b.publish("online", true, true)
+	b.publishState()
+}
+
+func (b *MQTTBridge) run() {
+	statusChan := b.service.State.NotifyChanged.On("status")
+	parameterChan := b.service.State.NotifyChanged.On("parameter")
+	defer b.service.State.NotifyChanged.Off("status", statusChan)
+	defer b.service.State.NotifyChanged.Off("parameter", parameterChan)
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-statusChan:
+		case <-parameterChan:
+		}
+		b.publishState()
+	}
+}
+
+func (b *MQTTBridge) publishState() {
+	snapshot := b.service.State.Snapshot()
+	state := snapshot.ParameterStream()
+
+	name := ""
+	if device := snapshot.OpenedDevice; device != nil {
+		name = topicName(device.Name)
+	}
+
+	b.mutex.Lock()
+	if name == "" {
+		// closed: report it on the topics of the device that was open last
+		name = b.publishedName
+	}
+	b.publishedName = name
+	b.mutex.Unlock()
+	if name == "" {
+		return
+	}
+
+	b.publish(name+"/opened", state.Opened, true)
+	b.publish(name+"/not_responding", state.NotResponding, true)
+	b.publish(name+"/armed", state.TriggerArmed, true)
+	b.publish(name+"/power_off_reason", state.PowerOffReason, true)
+	// unknown values are published as null
+	if state.Power != nil {
+		b.publishMessage(name+"/power", state.Power)
+	} else {
+		b.publishPayload(name+"/power", []byte("null"), true)
+	}
+	if state.Pulse != nil {
+		b.publishMessage(name+"/pulse", state.Pulse)
+	} else {
+		b.publishPayload(name+"/pulse", []byte("null"), true)
+	}
+}
+
+// Remove the retained state of the device that was published last.
+func (b *MQTTBridge) clearState() {
+	b.mutex.Lock()
+	name := b.publishedName
+	b.mutex.Unlock()
+	if name == "" {
+		return
+	}
+	for _, topic := range mqttStateTopics {
+		// an empty retained message deletes the retained one
+		b.publishPayload(name+"/"+topic, nil, true)
+	}
+}
+
+func (b *MQTTBridge) publishMessage(topic string, message proto.Message) {
+	payload, err := b.marshaler.MarshalToString(message)
+	if err != nil {
+		log.Errorf("Failed to encode %s: %s", topic, err.Error())
+		return
+	}
+	b.publishPayload(topic, []byte(payload), true)
+}
+
+func (b *MQTTBridge) publish(topic string, value interface{}, retained bool) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		log.Errorf("Failed to encode %s: %s", topic, err.Error())
+		return
+	}
+	b.publishPayload(topic, payload, retained)
+}
+
+func (b *MQTTBridge) publishPayload(topic string, payload []byte, retained bool) {
+	token := b.client.Publish(b.config.TopicPrefix+"/"+topic, mqttQoS, retained, payload)
+	if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+		log.Errorf("Failed to publish %s: %s", topic, token.Error().Error())
+	}
+}
+
+func (b *MQTTBridge) onCommand(client mqtt.Client, message mqtt.Message) {
+	// <prefix>/<device>/command/<name>
+	parts := strings.Split(strings.TrimPrefix(message.Topic(), b.config.TopicPrefix+"/"), "/")
+	if len(parts) != 3 {
+		return
+	}
+	device, name := parts[0], parts[2]
+
+	err := b.execute(device, name, message.Payload())
+	result := mqttResult{Command: name, OK: err == nil}
+	if err != nil {
+		result.Error = err.Error()
+		log.Warningf("MQTT command %s for %s failed: %s", name, device, err.Error())
+	}
+	b.publish(device+"/result", result, false)
+}
+
+func (b *MQTTBridge) execute(device string, name string, payload []byte) error {
+	opened := b.service.State.Snapshot().OpenedDevice
+	if opened == nil || topicName(opened.Name) != device {
+		return fmt.Errorf("device %s is not opened", device)
+	}
+
+	method, ok := mqttCommands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %s", name)
+	}
+	ctx, cancel := context.WithTimeout(b.context(), mqttTimeout)
+	defer cancel()
+	err := authorize(ctx, requiredRole(method))
+	if err != nil {
+		return err
+	}
+	if controllingCaller(ctx) {
+		b.service.DeadMan.Heartbeat()
+	}
+
+	switch name {
+	case "power":
+		req := &mvpulse.SetPowerReq{}
+		err := jsonpb.UnmarshalString(string(payload), req)
+		if err != nil {
+			return err
+		}
+		if req.Power == nil {
+			return errors.New("power is missing")
+		}
+		_, err = b.service.SetPower(ctx, req)
+		return err
+	case "pulse":
+		req := &mvpulse.SetPulseParamReq{}
+		err := jsonpb.UnmarshalString(string(payload), req)
+		if err != nil {
+			return err
+		}
+		if req.Pulse == nil {
+			return errors.New("pulse is missing")
+		}
+		_, err = b.service.SetPulseParam(ctx, req)
+		return err
+	case "trigger":
+		req := &mvpulse.SetTriggerArmReq{}
+		err := jsonpb.UnmarshalString(string(payload), req)
+		if err != nil {
+			return err
+		}
+		_, err = b.service.SetTriggerArm(ctx, req)
+		return err
+	default:
+		return fmt.Errorf("unknown command %s", name)
+	}
+}
+
+// Commands from the bridge are recorded under the client ID of the bridge with the role of the bridge.
+func (b *MQTTBridge) context() context.Context {
+	return context.WithValue(context.Background(), principalKey{}, Principal{
+		Name: "mqtt:" + b.config.ClientID,
+		Role: b.role,
+	})
+}
+
+// MQTT topic level for a device name: wildcards and separators are replaced.
+func topicName(name string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
@@ -0,0 +1,65 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestMQTTBridge_Role(t *testing.T) {
+	operator := RoleOperator
+	bridges := []struct {
+		auth   *AuthOptions
+		role   *Role
+		expect Role
+	}{
+		{nil, nil, RoleOperator},
+		{&AuthOptions{}, nil, RoleRead},
+		{&AuthOptions{}, &operator, RoleOperator},
+	}
+	for _, bridge := range bridges {
+		b := NewMQTTBridge(MQTTConfig{Role: bridge.role}, NewPulseSerice(), bridge.auth)
+		if b.role != bridge.expect {
+			t.Errorf("Auth %v, configured role %v: got %s, expected %s", bridge.auth, bridge.role, b.role, bridge.expect)
+		}
+	}
+}
+
+// A read-only bridge rejects commands before they reach the device.
+func TestMQTTBridge_ReadOnlyRejectsCommands(t *testing.T) {
+	config := DefaultConfig()
+	config.Simulate = 1
+	s := NewPulseSericeWithConfig(config)
+	ctx := context.Background()
+	_, err := s.Connect(ctx, &mvpulse.ConnectReq{DeviceIdentifier: &mvpulse.ConnectReq_Name{Name: "simulated-pulse-0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect(ctx, &mvpulse.DisconnectReq{})
+
+	b := NewMQTTBridge(MQTTConfig{}, s, &AuthOptions{})
+	err = b.execute("simulated-pulse-0", "power", []byte(`{}`))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Expected PermissionDenied but got %v", err)
+	}
+
+	// an operator bridge gets past the role check to the request itself
+	b = NewMQTTBridge(MQTTConfig{}, s, nil)
+	err = b.execute("simulated-pulse-0", "power", []byte(`{}`))
+	if err == nil || status.Code(err) == codes.PermissionDenied {
+		t.Fatalf("Expected the missing power to be reported but got %v", err)
+	}
+}
+
+func TestMQTTBridge_LastWill(t *testing.T) {
+	b := NewMQTTBridge(MQTTConfig{}, NewPulseSerice(), nil)
+	options := b.client.OptionsReader()
+	if !options.WillEnabled() || options.WillTopic() != DefaultMQTTTopicPrefix+"/online" || !options.WillRetained() {
+		t.Fatalf("Unexpected last will on %q, retained %t", options.WillTopic(), options.WillRetained())
+	}
+	if string(options.WillPayload()) != "false" {
+		t.Fatalf("Unexpected last will payload %q", options.WillPayload())
+	}
+}
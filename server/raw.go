@@ -0,0 +1,87 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/wuyuanyi135/mvcamctrl/history"
+	"github.com/wuyuanyi135/mvcamctrl/serial"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const (
+	maxRawLength      = 255
+	defaultRawTimeout = time.Second
+	maxRawTimeout     = 10 * time.Second
+)
+
+// Engineering passthrough: send an arbitrary opcode with arbitrary argument bytes and return the raw reply. The
+// command bypasses the safety policy and the cached state, so it requires the admin role. The power and the pulse
+// parameters are read back afterwards.
+func (s *PulseSerice) RawCommand(ctx context.Context, req *mvpulse.RawCommandReq) (resp *mvpulse.RawCommandRes, err error) {
+	defer func() { s.audit(ctx, "RawCommand", nil, req, err) }()
+
+	err = s.openGuard()
+	if err != nil {
+		return
+	}
+	err = s.leaseGuard(ctx)
+	if err != nil {
+		return
+	}
+
+	if req.Opcode > 0xff {
+		return nil, status.Errorf(codes.InvalidArgument, "opcode %#x does not fit in a byte", req.Opcode)
+	}
+	if len(req.Argument) > maxRawLength || req.ResponseLength > maxRawLength {
+		return nil, status.Errorf(codes.InvalidArgument, "argument and response are limited to %d bytes", maxRawLength)
+	}
+
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultRawTimeout
+	}
+	if timeout > maxRawTimeout {
+		timeout = maxRawTimeout
+	}
+
+	resp = &mvpulse.RawCommandRes{}
+	// the command may have changed anything, even when it failed
+	defer s.resyncAfterRaw(ctx)
+
+	requestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	response, err := s.deviceRequest(requestCtx, serial.SerialCommand{
+		Command: command.CommandMeta{
+			Command:        command.Command(req.Opcode),
+			RequestLength:  len(req.Argument),
+			ResponseLength: int(req.ResponseLength),
+		},
+		Arg: req.Argument,
+	})
+	if err != nil {
+		log.Errorf("Raw command %#x failed: %s", req.Opcode, err.Error())
+		return
+	}
+
+	log.Warningf("Raw command %#x % x answered % x", req.Opcode, req.Argument, response)
+	resp.Response = response
+	return
+}
+
+// Read back the power and the pulse parameters after a raw command. When they cannot be read, they are marked unknown
+// rather than keeping values the device may no longer have.
+func (s *PulseSerice) resyncAfterRaw(ctx context.Context) {
+	err := s.syncState(ctx)
+	if err == nil {
+		return
+	}
+	s.logger(ctx).Warningf("Failed to read the state after a raw command: %s", err.Error())
+	state := s.State.Update("status", func(next *StateSnapshot) {
+		next.Power = nil
+		next.Config = nil
+	})
+	s.event(history.Error, state.Revision, "state unknown after a raw command: %s", err.Error())
+}
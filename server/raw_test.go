@@ -0,0 +1,44 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"testing"
+)
+
+// A raw command that changes the device is reflected in the state.
+func TestRawCommand_Resyncs(t *testing.T) {
+	config := DefaultConfig()
+	config.Simulate = 1
+	s := NewPulseSericeWithConfig(config)
+	ctx := context.Background()
+	_, err := s.Connect(ctx, &mvpulse.ConnectReq{DeviceIdentifier: &mvpulse.ConnectReq_Name{Name: "simulated-pulse-0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect(ctx, &mvpulse.DisconnectReq{})
+
+	_, err = s.RawCommand(ctx, &mvpulse.RawCommandReq{
+		Opcode:   uint32(command.CommandSetPower.Command),
+		Argument: []byte{1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RawCommand(ctx, &mvpulse.RawCommandReq{
+		Opcode:   uint32(command.CommandSetExposure.Command),
+		Argument: []byte{0x2c, 0x01},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := s.State.Snapshot()
+	if state.Power == nil || !state.Power.MasterPower {
+		t.Fatalf("Expected the power on after the raw command but got %+v", state.Power)
+	}
+	if state.Config == nil || state.Config.ExposureTick.GetValue() != 300 {
+		t.Fatalf("Expected exposure 300 after the raw command but got %+v", state.Config)
+	}
+}
@@ -1,32 +1,309 @@
 package mvcamctrl
 
 import (
+	"context"
+	"fmt"
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-middleware/recovery"
+	"github.com/wuyuanyi135/mvcamctrl/audit"
+	"github.com/wuyuanyi135/mvcamctrl/history"
+	"github.com/wuyuanyi135/mvcamctrl/tracing"
 	"github.com/wuyuanyi135/mvprotos/mvpulse"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
-func StartServer() {
-	grpcServer := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
-			grpc_recovery.StreamServerInterceptor(),
-		)),
-		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			grpc_recovery.UnaryServerInterceptor(),
-		)),
+// A running daemon. Create it with StartServer and shut it down with Stop.
+type Server struct {
+	Service *PulseSerice
+
+	config     Config
+	grpcServer *grpc.Server
+	listeners  []net.Listener
+	httpServer *http.Server
+	auditLog   *audit.Log
+	history    *history.History
+	health     *HealthReporter
+	mqtt       *MQTTBridge
+	// flushes and stops the trace exporter
+	stopTracing func(context.Context) error
+
+	serveErrors chan error
+	stopOnce    sync.Once
+}
+
+// Start serving on every configured address. The server runs in the background until Stop is called.
+func StartServer(config Config) (*Server, error) {
+	if config.Simulate < 0 {
+		return nil, fmt.Errorf("invalid number of simulated pulse controllers %d", config.Simulate)
+	}
+	service := NewPulseSericeWithConfig(config)
+	if config.Simulate > 0 {
+		log.Warningf("Simulating %d pulse controllers; the serial ports are not used", config.Simulate)
+	}
+	if config.Safety != nil {
+		service.Policies = config.Safety
+	}
+
+	auditLog, err := audit.Open(config.AuditLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %s", err.Error())
+	}
+	service.AuditLog = auditLog
+
+	var serverOptions []grpc.ServerOption
+	if config.TLS != nil {
+		creds, err := config.TLS.ServerCredentials()
+		if err != nil {
+			_ = auditLog.Close()
+			return nil, fmt.Errorf("failed to set up TLS: %s", err.Error())
+		}
+		serverOptions = append(serverOptions, grpc.Creds(creds))
+	} else {
+		log.Warning("TLS is not configured. Serving plaintext gRPC.")
+	}
+
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpc_recovery.StreamServerInterceptor(),
+		service.LoggingStreamServerInterceptor(),
+		TracingStreamServerInterceptor(),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		grpc_recovery.UnaryServerInterceptor(),
+		service.LoggingUnaryServerInterceptor(),
+		TracingUnaryServerInterceptor(),
+	}
+	if config.Auth != nil {
+		streamInterceptors = append(streamInterceptors, config.Auth.StreamServerInterceptor())
+		unaryInterceptors = append(unaryInterceptors, config.Auth.UnaryServerInterceptor())
+	} else {
+		log.Warning("Authorization is not configured. Every client has full control.")
+	}
+	// only authorized calls count as heartbeats
+	streamInterceptors = append(streamInterceptors, service.DeadMan.StreamServerInterceptor())
+	unaryInterceptors = append(unaryInterceptors, service.DeadMan.UnaryServerInterceptor())
+
+	serverOptions = append(serverOptions,
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
 	)
-	mvpulse.RegisterMicroVisionPulseServiceServer(grpcServer, NewPulseSerice())
+	grpcServer := grpc.NewServer(serverOptions...)
+	mvpulse.RegisterMicroVisionPulseServiceServer(grpcServer, service)
 	reflection.Register(grpcServer)
-	lis, err := net.Listen("tcp", ":3050")
+	healthReporter, err := NewHealthReporter(grpcServer, service, HeartbeatOptions{
+		Interval: time.Duration(config.HealthProbeInterval),
+		Failures: config.HeartbeatFailures,
+		Recovery: config.HeartbeatRecovery,
+	})
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		_ = auditLog.Close()
+		return nil, err
+	}
+
+	s := &Server{
+		Service:     service,
+		config:      config,
+		grpcServer:  grpcServer,
+		auditLog:    auditLog,
+		health:      healthReporter,
+		serveErrors: make(chan error, len(config.Listen)+len(config.HTTPListen)+1),
+	}
+
+	var httpListeners []net.Listener
+	for i, address := range append(config.Listen, config.HTTPListen...) {
+		lis, err := listen(address)
+		if err != nil {
+			s.closeListeners()
+			for _, lis := range httpListeners {
+				_ = lis.Close()
+			}
+			_ = auditLog.Close()
+			return nil, fmt.Errorf("failed to listen on %s: %s", address, err.Error())
+		}
+		if i < len(config.Listen) {
+			s.listeners = append(s.listeners, lis)
+		} else {
+			httpListeners = append(httpListeners, lis)
+		}
+	}
+
+	if len(httpListeners) > 0 {
+		s.httpServer = &http.Server{
+			Handler:           NewGateway(service, config.Auth),
+			ReadHeaderTimeout: gatewayReadHeaderTimeout,
+		}
+		if config.TLS != nil {
+			// already validated by the gRPC credentials above
+			s.httpServer.TLSConfig, _ = config.TLS.ServerConfig()
+		}
+	}
+
+	s.history, err = history.Open(config.History, config.HistorySize)
+	if err != nil {
+		s.closeListeners()
+		for _, lis := range httpListeners {
+			_ = lis.Close()
+		}
+		_ = auditLog.Close()
+		return nil, fmt.Errorf("failed to open history: %s", err.Error())
+	}
+	service.History = s.history
+
+	s.stopTracing, err = tracing.Setup(config.Tracing)
+	if err != nil {
+		s.closeListeners()
+		for _, lis := range httpListeners {
+			_ = lis.Close()
+		}
+		_ = auditLog.Close()
+		_ = s.history.Close()
+		return nil, fmt.Errorf("failed to set up tracing: %s", err.Error())
+	}
+
+	service.DeadMan.Start()
+	healthReporter.Start()
+	for _, lis := range s.listeners {
+		log.Infof("Serving on %s", lis.Addr())
+		go func(lis net.Listener) {
+			s.serveErrors <- grpcServer.Serve(lis)
+		}(lis)
+	}
+	for _, lis := range httpListeners {
+		log.Infof("Serving HTTP gateway on %s", lis.Addr())
+		go s.serveHTTP(lis)
+	}
+
+	if config.DefaultDevice != "" {
+		s.connectDefaultDevice()
+	}
+
+	if config.MQTT != nil {
+		s.mqtt = NewMQTTBridge(*config.MQTT, service, config.Auth)
+		err = s.mqtt.Start()
+		if err != nil {
+			// the broker may come up later; the client keeps retrying in the background
+			log.Errorf("MQTT bridge: %s", err.Error())
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) serveHTTP(lis net.Listener) {
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		err = s.httpServer.ServeTLS(lis, "", "")
+	} else {
+		err = s.httpServer.Serve(lis)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		s.serveErrors <- err
+	}
+}
+
+// Parse "host:port", "tcp://host:port" or "unix:///path" and listen on it.
+func listen(address string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		return net.Listen("unix", strings.TrimPrefix(address, "unix://"))
+	case strings.HasPrefix(address, "tcp://"):
+		return net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+	default:
+		return net.Listen("tcp", address)
+	}
+}
+
+func (s *Server) connectDefaultDevice() {
+	req := &mvpulse.ConnectReq{}
+	if strings.HasPrefix(s.config.DefaultDevice, "/") || strings.Contains(s.config.DefaultDevice, "://") {
+		req.DeviceIdentifier = &mvpulse.ConnectReq_Path{Path: s.config.DefaultDevice}
+	} else {
+		req.DeviceIdentifier = &mvpulse.ConnectReq_Name{Name: s.config.DefaultDevice}
 	}
 
-	err = grpcServer.Serve(lis)
+	_, err := s.Service.Connect(context.Background(), req)
 	if err != nil {
-		log.Fatalf("failed to serve: %v", err)
+		log.Errorf("Failed to open default device %s: %s", s.config.DefaultDevice, err.Error())
+		return
+	}
+	log.Infof("Opened default device %s", s.config.DefaultDevice)
+}
+
+// Addresses the server is listening on, in the order of the configuration.
+func (s *Server) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, lis := range s.listeners {
+		addrs = append(addrs, lis.Addr())
+	}
+	return addrs
+}
+
+// Block until a listener fails or the server is stopped. Returns nil after a clean Stop.
+func (s *Server) Wait() error {
+	err := <-s.serveErrors
+	if err == grpc.ErrServerStopped {
+		return nil
+	}
+	return err
+}
+
+// Shut down: make the laser safe, close the port, end the streams and wait up to the shutdown timeout for running
+// calls before closing them.
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		log.Info("Shutting down")
+		s.health.Stop()
+		s.Service.DeadMan.Stop()
+		if s.mqtt != nil {
+			defer s.mqtt.Stop()
+		}
+		s.Service.Shutdown()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.ShutdownTimeout))
+		defer cancel()
+		if s.httpServer != nil {
+			err := s.httpServer.Shutdown(ctx)
+			if err != nil {
+				log.Warningf("HTTP gateway shutdown: %s", err.Error())
+				_ = s.httpServer.Close()
+			}
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			log.Warning("Graceful shutdown timed out. Closing remaining calls.")
+			s.grpcServer.Stop()
+		}
+
+		err := s.auditLog.Close()
+		if err != nil {
+			log.Errorf("Failed to close audit log: %s", err.Error())
+		}
+		err = s.history.Close()
+		if err != nil {
+			log.Errorf("Failed to close history: %s", err.Error())
+		}
+		err = s.stopTracing(ctx)
+		if err != nil {
+			log.Errorf("Failed to flush traces: %s", err.Error())
+		}
+		// unblock Wait when serving never started
+		s.serveErrors <- grpc.ErrServerStopped
+	})
+}
+
+func (s *Server) closeListeners() {
+	for _, lis := range s.listeners {
+		_ = lis.Close()
 	}
 }
@@ -3,70 +3,119 @@ package mvcamctrl
 import (
 	"context"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"github.com/golang/protobuf/ptypes/wrappers"
-	"github.com/olebedev/emitter"
-	"github.com/op/go-logging"
+	"github.com/wuyuanyi135/mvcamctrl/audit"
+	"github.com/wuyuanyi135/mvcamctrl/history"
+	"github.com/wuyuanyi135/mvcamctrl/logs"
+	"github.com/wuyuanyi135/mvcamctrl/safety"
 	"github.com/wuyuanyi135/mvcamctrl/serial"
 	"github.com/wuyuanyi135/mvcamctrl/serial/command"
+	"github.com/wuyuanyi135/mvcamctrl/serial/simulator"
+	"github.com/wuyuanyi135/mvcamctrl/tracing"
 	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io"
+	"strings"
+	"sync"
 	"time"
 )
 
 const DriverVersion = "1.0"
 
-var log = logging.MustGetLogger("Pulse")
-
-type State struct {
-	Power         *mvpulse.PowerConfiguration
-	Config        *mvpulse.PulseConfiguration
-	Opened        bool
-	TriggerArmed  bool
-	NotifyChanged *emitter.Emitter
-	OpenedDevice  *mvpulse.SerialDevice
-}
-
-func NewState() *State {
-
-	return &State{
-		Opened:        false,
-		Config:        nil,
-		Power:         nil,
-		NotifyChanged: &emitter.Emitter{},
-		TriggerArmed:  false,
-
-		OpenedDevice: nil,
-	}
-}
+var log = logs.New("Pulse")
 
 type PulseSerice struct {
-	serialInstance serial.Serial
+	serialInstance *serial.Serial
+	serialConfig   serial.Config
+	discovery      serial.DiscoveryConfig
 	State          *State
+	DeadMan        *DeadManSwitch
+	Policies       *safety.Policies
+	AuditLog       *audit.Log
+	History        *history.History
+
+	// virtual controllers listed and opened instead of the serial ports; nil unless simulating
+	simulation *simulator.Bench
+
+	// closed when the server shuts down to end the streams
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	// serializes opening and closing the port: Connect, Disconnect, Reset, probing and the heartbeat's recovery
+	portMutex sync.Mutex
+	// serializes acquiring, renewing, releasing and expiring the lease
+	leaseMutex sync.Mutex
+	// expires the current lease; guarded by leaseMutex
+	leaseTimer *time.Timer
+	// serializes SetPulseParam and switching the power on, so that no other write lands between checking the expected
+	// revision and updating the state
+	writeMutex sync.Mutex
 }
 
 func NewPulseSerice() *PulseSerice {
-	return &PulseSerice{
-		serialInstance: serial.NewSerial(),
+	return NewPulseSericeWithConfig(DefaultConfig())
+}
+
+func NewPulseSericeWithConfig(config Config) *PulseSerice {
+	s := &PulseSerice{
+		serialInstance: serial.NewSerialWithConfig(config.Serial),
+		serialConfig:   config.Serial,
+		discovery:      config.Devices,
 		State:          NewState(),
+		Policies:       safety.NewPolicies(safety.Policy{}),
+		AuditLog:       audit.NewMemoryLog(),
+		History:        history.New(history.DefaultSize),
+		shutdown:       make(chan struct{}),
 	}
+	if config.Simulate > 0 {
+		s.simulation = simulator.NewBench(config.Simulate)
+	}
+	s.DeadMan = NewDeadManSwitch(time.Duration(config.DeadManTimeout), s.deadManTripped)
+	return s
 }
 
-func (s *PulseSerice) GetDevices(context.Context, *mvpulse.GetDevicesReq) (resp *mvpulse.GetDevicesRes, err error) {
+func (s *PulseSerice) GetDevices(ctx context.Context, req *mvpulse.GetDevicesReq) (resp *mvpulse.GetDevicesRes, err error) {
 	resp = &mvpulse.GetDevicesRes{}
 
-	devList, err := serial.ListSerialPorts()
+	devList, err := s.devices().ListDevices()
 	if err != nil {
 		return
 	}
 
-	for name, destination := range devList {
-		resp.Devices = append(resp.Devices, &mvpulse.SerialDevice{
-			Name: name,
-			Path: destination,
-		})
+	opened := s.State.Snapshot().OpenedDevice
+	for _, found := range devList {
+		device := &mvpulse.SerialDevice{
+			Name:   found.Name,
+			Path:   found.Path,
+			Opened: opened != nil && opened.Path == found.Path,
+		}
+		if s.simulation != nil {
+			device.Product = "Simulated pulse controller"
+		} else if usb := serial.ReadUSBInfo(s.discovery.SysfsRoot, found.Path); usb != nil {
+			device.VendorId = usb.VendorID
+			device.ProductId = usb.ProductID
+			device.Manufacturer = usb.Manufacturer
+			device.Product = usb.Product
+			device.SerialNumber = usb.SerialNumber
+			device.UsbPath = usb.BusPath
+		}
+		resp.Devices = append(resp.Devices, device)
+	}
+
+	if req.Probe {
+		// probing writes to every port
+		err = authorize(ctx, RoleOperator)
+		if err != nil {
+			return nil, err
+		}
+		timeout := DefaultProbeTimeout
+		if req.ProbeTimeoutMs != 0 {
+			timeout = time.Duration(req.ProbeTimeoutMs) * time.Millisecond
+		}
+		s.probeDevices(ctx, resp.Devices, timeout)
 	}
 	return
 }
@@ -79,46 +128,84 @@ func (s *PulseSerice) DriverVersion(context.Context, *mvpulse.DriverVersionReq)
 }
 
 func (s *PulseSerice) Connect(ctx context.Context, req *mvpulse.ConnectReq) (resp *mvpulse.ConnectRes, err error) {
+	s.portMutex.Lock()
+	defer s.portMutex.Unlock()
+
+	state := s.State.Snapshot()
+	defer func() { s.audit(ctx, "Connect", state.OpenedDevice, req, err) }()
+
+	err = s.leaseGuard(ctx)
+	if err != nil {
+		return
+	}
+
 	resp = &mvpulse.ConnectRes{}
-	if s.State.Opened && (s.State.OpenedDevice.Name == req.GetName() || s.State.OpenedDevice.Path == req.GetPath()) {
-		log.Warning("Repeat open detected. Ignore.")
+	if state.Opened && (state.OpenedDevice.Name == req.GetName() || state.OpenedDevice.Path == resolvePath(req.GetPath())) {
+		s.logger(ctx).Warning("Repeat open detected. Ignore.")
+		resp.Revision = state.Revision
 		return
 	}
 	var path, name string
 	switch req.DeviceIdentifier.(type) {
 	case *mvpulse.ConnectReq_Path:
-		path = req.GetPath()
-		err = s.serialInstance.ConnectByPath(req.GetPath())
+		path = resolvePath(req.GetPath())
+		err = s.openDevice(path)
 		if err != nil {
 			return
 		}
 
-		mapping, err := serial.ListSerialPorts()
+		devices, err := s.devices().ListDevices()
 		if err != nil {
 			return nil, err
 		}
-		for k, v := range mapping {
-			if v == path {
-				name = k
+		for _, device := range devices {
+			if device.Path == path {
+				name = device.Name
 				break
 			}
 		}
 	case *mvpulse.ConnectReq_Name:
 		name = req.GetName()
-		err, path = s.serialInstance.ConnectByName(req.GetName())
+		device, ok, err := s.devices().FindDevice(name)
 		if err != nil {
-			return
+			return nil, err
+		}
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "no serial device named %q", name)
+		}
+		path = device.Path
+		err = s.openDevice(path)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	s.State.SetOpened(mvpulse.SerialDevice{
+	opened := s.State.SetOpened(mvpulse.SerialDevice{
 		Path: path,
 		Name: name,
 	})
+	s.event(history.Connect, opened.Revision, "opened %s", path)
+
+	// the device stays open when it cannot be read; the state is filled in by the next setters
+	syncErr := s.syncState(ctx)
+	if syncErr != nil {
+		s.logger(ctx).Warningf("Failed to read the state of %s: %s", path, syncErr.Error())
+		s.event(history.Error, 0, "failed to read the state: %s", syncErr.Error())
+	}
+	resp.Revision = s.State.Snapshot().Revision
 	return
 }
 
-func (s *PulseSerice) Disconnect(context.Context, *mvpulse.DisconnectReq) (resp *mvpulse.DisconnectRes, err error) {
+func (s *PulseSerice) Disconnect(ctx context.Context, req *mvpulse.DisconnectReq) (resp *mvpulse.DisconnectRes, err error) {
+	s.portMutex.Lock()
+	defer s.portMutex.Unlock()
+	defer func(old *mvpulse.SerialDevice) { s.audit(ctx, "Disconnect", old, nil, err) }(s.State.Snapshot().OpenedDevice)
+
+	err = s.leaseGuard(ctx)
+	if err != nil {
+		return
+	}
+
 	resp = &mvpulse.DisconnectRes{}
 
 	err = s.serialInstance.Disconnect()
@@ -126,7 +213,8 @@ func (s *PulseSerice) Disconnect(context.Context, *mvpulse.DisconnectReq) (resp
 		return
 	}
 
-	s.State.SetClosed()
+	s.event(history.Disconnect, 0, "closed")
+	resp.Revision = s.State.SetClosed().Revision
 	return
 }
 
@@ -141,7 +229,7 @@ func (s *PulseSerice) DeviceVersion(ctx context.Context, req *mvpulse.DeviceVers
 		},
 	)
 	if err != nil {
-		log.Errorf("Get device version error: %s", err.Error())
+		s.logger(ctx).Errorf("Get device version error: %s", err.Error())
 		return
 	}
 
@@ -152,6 +240,17 @@ func (s *PulseSerice) DeviceVersion(ctx context.Context, req *mvpulse.DeviceVers
 }
 
 func (s *PulseSerice) SetPower(ctx context.Context, req *mvpulse.SetPowerReq) (resp *mvpulse.SetPowerRes, err error) {
+	if req.Power == nil {
+		return nil, status.Error(codes.InvalidArgument, "power is missing")
+	}
+	// switching the laser off does not wait for other writes
+	if req.Power.MasterPower {
+		s.writeMutex.Lock()
+		defer s.writeMutex.Unlock()
+	}
+	state := s.State.Snapshot()
+	defer func() { s.audit(ctx, "SetPower", state.Power, req.Power, err) }()
+
 	err = s.openGuard()
 	if err != nil {
 		return
@@ -159,11 +258,34 @@ func (s *PulseSerice) SetPower(ctx context.Context, req *mvpulse.SetPowerReq) (r
 
 	resp = &mvpulse.SetPowerRes{}
 
-	ctx, _ = context.WithTimeout(ctx, time.Second)
 	var power byte = 0
 	if req.Power.MasterPower {
 		power = 1
+
+		// switching the laser off is always allowed
+		err = s.leaseGuard(ctx)
+		if err != nil {
+			return
+		}
+		err = checkRevision(req.ExpectedRevision, state.PowerRevision, "power")
+		if err != nil {
+			return
+		}
+
+		// a configuration that could not be read cannot be checked
+		if state.Config == nil && !s.Policies.For(state.OpenedDevice).Empty() {
+			log.Warningf("Safety policy violation: power on with unknown pulse parameters")
+			err = status.Error(codes.FailedPrecondition,
+				"safety policy: the pulse parameters are unknown; set them before switching the power on")
+			return
+		}
+		err = s.checkPolicy(state.Config)
+		if err != nil {
+			return
+		}
 	}
+
+	ctx, _ = context.WithTimeout(ctx, time.Second)
 	_, err = s.deviceRequest(
 		ctx,
 		serial.SerialCommand{
@@ -171,12 +293,18 @@ func (s *PulseSerice) SetPower(ctx context.Context, req *mvpulse.SetPowerReq) (r
 			Arg:     []byte{power},
 		})
 	if err != nil {
-		log.Errorf("Set power error: %s", err.Error())
+		s.logger(ctx).Errorf("Set power error: %s", err.Error())
 		return
 	}
 
-	s.State.Power = req.Power
-	s.State.NotifyChanged.Emit("status")
+	state = s.State.Update("status", func(next *StateSnapshot) {
+		next.Power = req.Power
+		if req.Power.MasterPower {
+			next.PowerOffReason = ""
+		}
+	})
+	s.event(history.Power, state.Revision, "power %s", onOff(req.Power.MasterPower))
+	resp.Revision = state.Revision
 	return
 }
 
@@ -186,31 +314,60 @@ func (s *PulseSerice) GetPower(ctx context.Context, req *mvpulse.GetPowerReq) (r
 		return
 	}
 
+	ctx, _ = context.WithTimeout(ctx, time.Second)
+	power, err := s.readPower(ctx)
+	if err != nil {
+		return
+	}
+
 	resp = &mvpulse.GetPowerRes{
-		Power: &mvpulse.PowerConfiguration{},
+		Power:    power,
+		Revision: s.State.Snapshot().Revision,
 	}
+	return
+}
 
-	ctx, _ = context.WithTimeout(ctx, time.Second)
+func (s *PulseSerice) readPower(ctx context.Context) (*mvpulse.PowerConfiguration, error) {
 	power, err := s.deviceRequest(ctx, serial.SerialCommand{
 		Command: command.CommandGetPower,
 	})
 	if err != nil {
-		log.Errorf("Get power error: %s", err.Error())
-		return
+		s.logger(ctx).Errorf("Get power error: %s", err.Error())
+		return nil, err
 	}
-
-	resp.Power.MasterPower = power[0] == 1
-	return
+	return &mvpulse.PowerConfiguration{MasterPower: power[0] == 1}, nil
 }
 
 func (s *PulseSerice) SetPulseParam(ctx context.Context, req *mvpulse.SetPulseParamReq) (resp *mvpulse.SetPulseParamRes, err error) {
+	if req.Pulse == nil {
+		return nil, status.Error(codes.InvalidArgument, "pulse is missing")
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	state := s.State.Snapshot()
+	defer func() { s.audit(ctx, "SetPulseParam", state.Config, req, err) }()
+
 	err = s.openGuard()
 	if err != nil {
 		return
 	}
+	err = s.leaseGuard(ctx)
+	if err != nil {
+		return
+	}
+
+	err = checkRevision(req.ExpectedRevision, state.ConfigRevision, "pulse parameters")
+	if err != nil {
+		return
+	}
 
 	resp = &mvpulse.SetPulseParamRes{}
 
+	err = s.checkPolicy(mergePulse(state.Config, req.Pulse))
+	if err != nil {
+		return
+	}
+
 	ctx, _ = context.WithTimeout(ctx, time.Second)
 
 	config := req.Pulse
@@ -226,7 +383,7 @@ func (s *PulseSerice) SetPulseParam(ctx context.Context, req *mvpulse.SetPulsePa
 			},
 		)
 		if err != nil {
-			log.Errorf("Failed to set exposure: %s", err)
+			s.logger(ctx).Errorf("Failed to set exposure: %s", err)
 			return
 		}
 	}
@@ -242,7 +399,7 @@ func (s *PulseSerice) SetPulseParam(ctx context.Context, req *mvpulse.SetPulsePa
 			},
 		)
 		if err != nil {
-			log.Errorf("Failed to set filter: %s", err)
+			s.logger(ctx).Errorf("Failed to set filter: %s", err)
 			return
 		}
 	}
@@ -258,7 +415,7 @@ func (s *PulseSerice) SetPulseParam(ctx context.Context, req *mvpulse.SetPulsePa
 			},
 		)
 		if err != nil {
-			log.Errorf("Failed to set exposure: %s", err)
+			s.logger(ctx).Errorf("Failed to set exposure: %s", err)
 			return
 		}
 	}
@@ -280,7 +437,7 @@ func (s *PulseSerice) SetPulseParam(ctx context.Context, req *mvpulse.SetPulsePa
 			},
 		)
 		if err != nil {
-			log.Errorf("Failed to set exposure: %s", err)
+			s.logger(ctx).Errorf("Failed to set exposure: %s", err)
 			return
 		}
 	}
@@ -291,13 +448,16 @@ func (s *PulseSerice) SetPulseParam(ctx context.Context, req *mvpulse.SetPulsePa
 		})
 
 		if err != nil {
-			log.Errorf("Failed to commit parameter: %s", err.Error())
+			s.logger(ctx).Errorf("Failed to commit parameter: %s", err.Error())
 			return
 		}
 	}
 
-	s.State.Config = req.Pulse
-	s.State.NotifyChanged.Emit("parameter")
+	state = s.State.Update("parameter", func(next *StateSnapshot) {
+		next.Config = mergePulse(next.Config, req.Pulse)
+	})
+	s.event(history.Parameter, state.Revision, "%s", pulseText(state.Config))
+	resp.Revision = state.Revision
 	return
 }
 
@@ -307,77 +467,99 @@ func (s *PulseSerice) GetPulseParam(ctx context.Context, req *mvpulse.GetPulsePa
 		return
 	}
 
+	ctx, _ = context.WithTimeout(ctx, time.Second)
+	pulse, err := s.readPulseParam(ctx)
+	if err != nil {
+		return
+	}
+
 	resp = &mvpulse.GetPulseParamRes{
-		Pulse: &mvpulse.PulseConfiguration{},
+		Pulse:    pulse,
+		Revision: s.State.Snapshot().Revision,
 	}
+	return
+}
 
-	ctx, _ = context.WithTimeout(ctx, time.Second)
-	// exposure
-	b := make([]byte, command.CommandGetExposure.ResponseLength)
+func (s *PulseSerice) readPulseParam(ctx context.Context) (*mvpulse.PulseConfiguration, error) {
+	pulse := &mvpulse.PulseConfiguration{}
 
+	// exposure
 	param, err := s.deviceRequest(
 		ctx,
 		serial.SerialCommand{
 			Command: command.CommandGetExposure,
-			Arg:     b,
 		},
 	)
 	if err != nil {
-		log.Errorf("Failed to get exposure: %s", err)
-		return
+		s.logger(ctx).Errorf("Failed to get exposure: %s", err)
+		return nil, err
 	}
-	resp.Pulse.ExposureTick = &wrappers.UInt32Value{Value: uint32(binary.LittleEndian.Uint16(param))}
+	pulse.ExposureTick = &wrappers.UInt32Value{Value: uint32(binary.LittleEndian.Uint16(param))}
 
 	// filter
-	b = make([]byte, command.CommandGetFilter.ResponseLength)
-
 	param, err = s.deviceRequest(
 		ctx,
 		serial.SerialCommand{
 			Command: command.CommandGetFilter,
-			Arg:     b,
 		},
 	)
 	if err != nil {
-		log.Errorf("Failed to get filter: %s", err)
-		return
+		s.logger(ctx).Errorf("Failed to get filter: %s", err)
+		return nil, err
 	}
 
-	resp.Pulse.DigitalFilter = &wrappers.UInt32Value{Value: uint32(binary.LittleEndian.Uint16(param))}
+	pulse.DigitalFilter = &wrappers.UInt32Value{Value: uint32(binary.LittleEndian.Uint16(param))}
 
 	// delay
-	b = make([]byte, command.CommandGetDelay.ResponseLength)
-
 	param, err = s.deviceRequest(
 		ctx,
 		serial.SerialCommand{
 			Command: command.CommandGetDelay,
-			Arg:     b,
 		},
 	)
 	if err != nil {
-		log.Errorf("Failed to get delay: %s", err)
-		return
+		s.logger(ctx).Errorf("Failed to get delay: %s", err)
+		return nil, err
 	}
-	resp.Pulse.PulseDelay = &wrappers.UInt32Value{Value: uint32(binary.LittleEndian.Uint16(param))}
+	pulse.PulseDelay = &wrappers.UInt32Value{Value: uint32(binary.LittleEndian.Uint16(param))}
 
 	// polarity
-	b = make([]byte, command.CommandGetPolarity.ResponseLength)
-
 	param, err = s.deviceRequest(
 		ctx,
 		serial.SerialCommand{
 			Command: command.CommandGetPolarity,
-			Arg:     b,
 		},
 	)
 	if err != nil {
-		log.Errorf("Failed to get delay: %s", err)
-		return
+		s.logger(ctx).Errorf("Failed to get polarity: %s", err)
+		return nil, err
 	}
-	resp.Pulse.Polarity = &wrappers.BoolValue{Value: param[0] == 1}
+	pulse.Polarity = &wrappers.BoolValue{Value: param[0] == 1}
 
-	return
+	return pulse, nil
+}
+
+// Read the power and the pulse parameters from the device into the state, so that the clients see the device as it is
+// right after it was opened. The firmware cannot report whether the trigger is armed; it stays disarmed in the state.
+func (s *PulseSerice) syncState(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	power, err := s.readPower(ctx)
+	if err != nil {
+		return err
+	}
+	pulse, err := s.readPulseParam(ctx)
+	if err != nil {
+		return err
+	}
+
+	state := s.State.Update("status", func(next *StateSnapshot) {
+		next.Power = power
+		next.Config = pulse
+	})
+	s.event(history.Resync, state.Revision, "read power %s, %s", onOff(power.MasterPower), pulseText(pulse))
+	return nil
 }
 
 func (s *PulseSerice) CommitParameter(ctx context.Context, req *mvpulse.CommitParameterReq) (resp *mvpulse.CommitParameterRes, err error) {
@@ -385,6 +567,10 @@ func (s *PulseSerice) CommitParameter(ctx context.Context, req *mvpulse.CommitPa
 	if err != nil {
 		return
 	}
+	err = s.leaseGuard(ctx)
+	if err != nil {
+		return
+	}
 
 	resp = &mvpulse.CommitParameterRes{}
 
@@ -395,13 +581,17 @@ func (s *PulseSerice) CommitParameter(ctx context.Context, req *mvpulse.CommitPa
 	})
 
 	if err != nil {
-		log.Errorf("Failed to commit parameter: %s", err.Error())
+		s.logger(ctx).Errorf("Failed to commit parameter: %s", err.Error())
 		return
 	}
+	// committing does not change the state
+	resp.Revision = s.State.Snapshot().Revision
 	return
 }
 
 func (s *PulseSerice) SetTriggerArm(ctx context.Context, req *mvpulse.SetTriggerArmReq) (resp *mvpulse.SetTriggerArmRes, err error) {
+	defer func(old bool) { s.audit(ctx, "SetTriggerArm", old, req.ArmTrigger, err) }(s.State.Snapshot().TriggerArmed)
+
 	err = s.openGuard()
 	if err != nil {
 		return
@@ -413,6 +603,11 @@ func (s *PulseSerice) SetTriggerArm(ctx context.Context, req *mvpulse.SetTrigger
 
 	var cmd command.CommandMeta
 	if req.ArmTrigger {
+		// disarming is always allowed
+		err = s.leaseGuard(ctx)
+		if err != nil {
+			return
+		}
 		cmd = command.CommandArmTrigger
 	} else {
 		cmd = command.CommandCancelTrigger
@@ -422,12 +617,19 @@ func (s *PulseSerice) SetTriggerArm(ctx context.Context, req *mvpulse.SetTrigger
 		Command: cmd,
 	})
 	if err != nil {
-		log.Errorf("Failed to control laser: %s", err.Error())
+		s.logger(ctx).Errorf("Failed to control laser: %s", err.Error())
 		return
 	}
 
-	s.State.TriggerArmed = req.ArmTrigger
-	s.State.NotifyChanged.Emit("status")
+	state := s.State.Update("status", func(next *StateSnapshot) {
+		next.TriggerArmed = req.ArmTrigger
+	})
+	if req.ArmTrigger {
+		s.event(history.Trigger, state.Revision, "armed")
+	} else {
+		s.event(history.Trigger, state.Revision, "disarmed")
+	}
+	resp.Revision = state.Revision
 	return
 }
 
@@ -437,17 +639,27 @@ func (s *PulseSerice) GetTriggerArm(context.Context, *mvpulse.GetTriggerArmReq)
 		return
 	}
 
+	state := s.State.Snapshot()
 	resp = &mvpulse.GetTriggerArmRes{
-		ArmTrigger: s.State.TriggerArmed,
+		ArmTrigger: state.TriggerArmed,
+		Revision:   state.Revision,
 	}
 	return
 }
 
 func (s *PulseSerice) Reset(ctx context.Context, req *mvpulse.ResetReq) (resp *mvpulse.ResetRes, err error) {
+	s.portMutex.Lock()
+	defer s.portMutex.Unlock()
+	defer func(old *mvpulse.SerialDevice) { s.audit(ctx, "Reset", old, nil, err) }(s.State.Snapshot().OpenedDevice)
+
 	err = s.openGuard()
 	if err != nil {
 		return
 	}
+	err = s.leaseGuard(ctx)
+	if err != nil {
+		return
+	}
 
 	resp = &mvpulse.ResetRes{}
 	ctx, _ = context.WithTimeout(ctx, time.Second)
@@ -457,7 +669,7 @@ func (s *PulseSerice) Reset(ctx context.Context, req *mvpulse.ResetReq) (resp *m
 	})
 
 	if err != nil {
-		log.Errorf("Failed to reset: %s", err.Error())
+		s.logger(ctx).Errorf("Failed to reset: %s", err.Error())
 		return
 	}
 
@@ -466,85 +678,151 @@ func (s *PulseSerice) Reset(ctx context.Context, req *mvpulse.ResetReq) (resp *m
 		return
 	}
 
-	s.State.SetClosed()
+	s.event(history.Disconnect, 0, "reset")
+	resp.Revision = s.State.SetClosed().Revision
 	return
 }
 
 func (s *PulseSerice) Opened(context.Context, *mvpulse.OpenedReq) (resp *mvpulse.OpenedRes, err error) {
+	state := s.State.Snapshot()
 	resp = &mvpulse.OpenedRes{
-		OpenedDevice: s.State.OpenedDevice,
-		Opened:       s.State.Opened,
+		OpenedDevice:  state.OpenedDevice,
+		Opened:        state.Opened,
+		NotResponding: state.NotResponding,
+		Lease:         state.liveLease().proto(false),
+		Revision:      state.Revision,
 	}
 	return
 }
 
+// ParameterStreaming sends the full state as soon as the stream opens and again after every change. Every message
+// carries the state revision and a per-stream sequence number. Each inbound message is applied and answered with an
+// acknowledgement holding its request ID and status, so a rejected request does not end the stream.
 func (s *PulseSerice) ParameterStreaming(srv mvpulse.MicroVisionPulseService_ParameterStreamingServer) (err error) {
 
 	ctx := srv.Context()
 	end := make(chan interface{})
+	var endOnce sync.Once
 	finalize := func() {
-		close(end)
+		endOnce.Do(func() { close(end) })
 	}
 	defer finalize()
+
+	// state updates and acknowledgements are sent from different goroutines
+	var sendMutex sync.Mutex
+	var sequence uint64
+	send := func(message *mvpulse.ParameterStream) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		sequence++
+		message.Sequence = sequence
+		return srv.Send(message)
+	}
+
+	// subscribe before taking the snapshot so that no change is missed in between
+	statusChan := s.State.NotifyChanged.On("status")
+	parameterChan := s.State.NotifyChanged.On("parameter")
+	sendErr := make(chan error, 1)
 	go func() {
-		statusChan := s.State.NotifyChanged.On("status")
-		parameterChan := s.State.NotifyChanged.On("parameter")
+		defer s.State.NotifyChanged.Off("status", statusChan)
+		defer s.State.NotifyChanged.Off("parameter", parameterChan)
 		for {
+			err := send(s.State.ParameterStream())
+			if err != nil {
+				sendErr <- err
+				return
+			}
 			select {
 			case <-statusChan:
-				err = srv.Send(&mvpulse.ParameterStream{Opened: s.State.Opened, TriggerArmed: s.State.TriggerArmed, Power: s.State.Power, Pulse: s.State.Config})
-				if err != nil {
-					finalize()
-				}
 			case <-parameterChan:
-				err = srv.Send(&mvpulse.ParameterStream{Opened: s.State.Opened, TriggerArmed: s.State.TriggerArmed, Power: s.State.Power, Pulse: s.State.Config})
-				if err != nil {
-					finalize()
-				}
-			case _, ok := <-end:
-				if !ok {
-					s.State.NotifyChanged.Off("status", statusChan)
-					s.State.NotifyChanged.Off("parameter", parameterChan)
-					return
-				}
+			case <-end:
+				return
 			}
 		}
+	}()
 
+	// receive in the background so that the stream can be ended while a client is idle
+	requests := make(chan *mvpulse.ParameterStream)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := srv.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-end:
+				return
+			}
+		}
 	}()
+
 	for {
+		var req *mvpulse.ParameterStream
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
+		case <-s.shutdown:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case err := <-sendErr:
+			return err
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case req = <-requests:
 		}
 
-		req, err := srv.Recv()
-		if err == io.EOF {
-			return nil
+		requestErr := s.applyStreamRequest(ctx, req)
+		if requestErr != nil {
+			s.logger(ctx).Warningf("Stream request %d failed: %s", req.RequestId, requestErr.Error())
+		}
+		// report the state after the request
+		ack := s.State.ParameterStream()
+		ack.RequestId = req.RequestId
+		ack.Ack = &mvpulse.ParameterStreamAck{
+			RequestId: req.RequestId,
+			Status:    status.Convert(requestErr).Proto(),
 		}
+		err = send(ack)
 		if err != nil {
 			return err
 		}
+	}
+}
 
-		if req.Pulse != nil {
-			_, err = s.SetPulseParam(ctx, &mvpulse.SetPulseParamReq{Pulse: req.Pulse, Commit: true})
-			if err != nil {
-				return err
-			}
-		}
-		if req.Power != nil {
-			_, err = s.SetPower(ctx, &mvpulse.SetPowerReq{Power: req.Power})
-			if err != nil {
-				return err
-			}
+// Apply the pulse and power settings of a message received on ParameterStreaming.
+func (s *PulseSerice) applyStreamRequest(ctx context.Context, req *mvpulse.ParameterStream) (err error) {
+	if req.Pulse == nil && req.Power == nil {
+		return nil
+	}
+	err = authorize(ctx, RoleOperator)
+	if err != nil {
+		return
+	}
+	if req.Pulse != nil {
+		_, err = s.SetPulseParam(ctx, &mvpulse.SetPulseParamReq{Pulse: req.Pulse, Commit: true})
+		if err != nil {
+			return
 		}
 	}
+	if req.Power != nil {
+		_, err = s.SetPower(ctx, &mvpulse.SetPowerReq{Power: req.Power})
+	}
+	return
 }
 
 func (s *PulseSerice) deviceRequest(ctx context.Context, command serial.SerialCommand) ([]byte, error) {
-	if ctx != nil {
-		command.Ctx = ctx
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	ctx, span := tracer.Start(ctx, "device "+command.Command.Command.String(), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.AttributeOpcode.String(command.Command.Command.String())))
+	defer span.End()
+	command.Ctx = ctx
 
 	if command.ResponseChannel == nil {
 		command.ResponseChannel = make(chan []byte)
@@ -552,36 +830,146 @@ func (s *PulseSerice) deviceRequest(ctx context.Context, command serial.SerialCo
 
 	err := s.serialInstance.WriteCommandAndRegisterResponse(command)
 	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
 		return nil, err
 	}
 
 	select {
-	case response := <-command.ResponseChannel:
-		return response, nil
+	case response, ok := <-command.ResponseChannel:
+		if ok {
+			return response, nil
+		}
 	case <-ctx.Done():
-		return nil, status.Errorf(codes.DeadlineExceeded, "%#v command time out", command)
 	}
+	span.SetStatus(otelcodes.Error, "timed out")
+	s.logger(ctx).With(logs.FieldOpcode, command.Command.Command.String()).Warningf("Device did not respond")
+	s.event(history.Timeout, 0, "no response to %s", command.Command.Command)
+	return nil, status.Errorf(codes.DeadlineExceeded, "%s command timed out", command.Command.Command)
 }
 
-func (s *State) SetOpened(openedDevice mvpulse.SerialDevice) {
-	s.OpenedDevice = &openedDevice
-	s.Opened = true
-	s.TriggerArmed = false
-	s.Power = nil
-	s.Config = nil
-	s.NotifyChanged.Emit("status")
+// Shut the laser down without a client asking for it: cancel the trigger, switch the power off and record the reason
+// so that it is reported in the next status message. The power is switched off even when cancelling the trigger
+// fails, and each step has its own timeout so that a hung command does not use up the time of the other.
+func (s *PulseSerice) safeOff(reason string) (err error) {
+	ctx := context.Background()
+	defer func(old *mvpulse.PowerConfiguration) { s.audit(ctx, "SafeOff", old, reason, err) }(s.State.Snapshot().Power)
+
+	var failures []string
+	triggerErr := s.safeOffStep(ctx, command.CommandCancelTrigger, nil)
+	if triggerErr != nil {
+		s.logger(ctx).Errorf("Failed to cancel trigger: %s", triggerErr.Error())
+		failures = append(failures, "cancel trigger: "+triggerErr.Error())
+	} else {
+		s.State.Update("status", func(next *StateSnapshot) {
+			next.TriggerArmed = false
+		})
+	}
+
+	powerErr := s.safeOffStep(ctx, command.CommandSetPower, []byte{0})
+	if powerErr != nil {
+		s.logger(ctx).Errorf("Failed to switch power off: %s", powerErr.Error())
+		failures = append(failures, "power off: "+powerErr.Error())
+	} else {
+		state := s.State.Update("status", func(next *StateSnapshot) {
+			next.Power = &mvpulse.PowerConfiguration{MasterPower: false}
+			next.PowerOffReason = reason
+		})
+		s.event(history.SafeOff, state.Revision, "%s", reason)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("safe off failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
 }
-func (s *State) SetClosed() {
-	s.OpenedDevice = nil
-	s.Opened = false
-	s.TriggerArmed = false
-	s.Power = nil
-	s.Config = nil
-	s.NotifyChanged.Emit("parameter")
+
+func (s *PulseSerice) safeOffStep(ctx context.Context, meta command.CommandMeta, arg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err := s.deviceRequest(ctx, serial.SerialCommand{
+		Command: meta,
+		Arg:     arg,
+	})
+	return err
 }
+
+// Make the laser safe and release the port before the server exits. Streams are ended as well.
+func (s *PulseSerice) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+
+	s.portMutex.Lock()
+	defer s.portMutex.Unlock()
+	if !s.State.Snapshot().Opened {
+		return
+	}
+
+	err := s.safeOff("server shutting down")
+	if err != nil {
+		log.Errorf("Failed to switch laser off on shutdown: %s", err.Error())
+	}
+
+	err = s.serialInstance.Disconnect()
+	if err != nil {
+		log.Errorf("Failed to disconnect on shutdown: %s", err.Error())
+		return
+	}
+	s.event(history.Disconnect, 0, "server shutting down")
+	s.State.SetClosed()
+}
+
+func (s *PulseSerice) deadManTripped(idle time.Duration) {
+	state := s.State.Snapshot()
+	if !state.Opened || !state.Live() {
+		return
+	}
+
+	reason := fmt.Sprintf("dead-man switch: no controlling client for %s", idle.Round(time.Second))
+	log.Warningf("Switching laser off, %s", reason)
+	err := s.safeOff(reason)
+	if err != nil {
+		log.Errorf("Dead-man switch failed to switch laser off: %s", err.Error())
+	}
+}
+
+// Reject the pulse configuration if it violates the safety policy of the opened device.
+func (s *PulseSerice) checkPolicy(config *mvpulse.PulseConfiguration) error {
+	err := s.Policies.For(s.State.Snapshot().OpenedDevice).CheckPulse(config)
+	if err != nil {
+		log.Warningf("Safety policy violation: %s", err.Error())
+		return status.Errorf(codes.FailedPrecondition, "safety policy: %s", err.Error())
+	}
+	return nil
+}
+
+// Overlay the fields set in update onto base. Neither argument is modified.
+func mergePulse(base *mvpulse.PulseConfiguration, update *mvpulse.PulseConfiguration) *mvpulse.PulseConfiguration {
+	merged := &mvpulse.PulseConfiguration{}
+	if base != nil {
+		*merged = *base
+	}
+	if update == nil {
+		return merged
+	}
+	if update.ExposureTick != nil {
+		merged.ExposureTick = update.ExposureTick
+	}
+	if update.DigitalFilter != nil {
+		merged.DigitalFilter = update.DigitalFilter
+	}
+	if update.PulseDelay != nil {
+		merged.PulseDelay = update.PulseDelay
+	}
+	if update.Polarity != nil {
+		merged.Polarity = update.Polarity
+	}
+	return merged
+}
+
 func (s *PulseSerice) openGuard() error {
-	if !s.State.Opened {
-		return errors.New("device not opened")
+	if !s.State.Snapshot().Opened {
+		return status.Error(codes.FailedPrecondition, "device not opened")
 	}
 	return nil
 }
@@ -6,40 +6,29 @@ import (
 	"fmt"
 	"github.com/wuyuanyi135/mvprotos/mvpulse"
 	"google.golang.org/grpc"
-	"net"
+	"google.golang.org/grpc/status"
+	"os"
 	"testing"
 	"time"
 )
 
 func TestMain(m *testing.M) {
-	go StartTestServer(context.Background())
-	client, err := GetClient()
+	config := DefaultConfig()
+	config.DeadManTimeout = 0
+	server, err := StartServer(config)
 	if err != nil {
 		panic(err)
 	}
-	disconnect(client)
-	m.Run()
-}
-
-func StartTestServer(ctx context.Context) {
-	grpcServer := grpc.NewServer()
-	mvpulse.RegisterMicroVisionPulseServiceServer(grpcServer, NewPulseSerice())
-
-	lis, err := net.Listen("tcp", ":3050")
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
-	}
 
-	err = grpcServer.Serve(lis)
+	client, err := GetClient()
 	if err != nil {
-		log.Fatalf("failed to serve: %v", err)
+		panic(err)
 	}
+	disconnect(client)
+	code := m.Run()
 
-	done := ctx.Done()
-	if done != nil {
-		<-done
-		grpcServer.GracefulStop()
-	}
+	server.Stop()
+	os.Exit(code)
 }
 
 var conn *grpc.ClientConn
@@ -243,6 +232,18 @@ func TestParameterStreaming(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// the current state is sent right away
+	t.Log("Test initial snapshot")
+	{
+		stream, err := streamingClient.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.Opened || stream.Sequence != 1 {
+			t.Fatalf("unexpected snapshot %#v", stream)
+		}
+	}
+
 	// test connect message
 	t.Log("Test connect message")
 	{
@@ -257,6 +258,15 @@ func TestParameterStreaming(t *testing.T) {
 		if !stream.Opened {
 			t.Fatal("Open message not received")
 		}
+
+		// followed by the state read from the device
+		stream, err = streamingClient.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream.Power == nil || stream.Pulse == nil || stream.Pulse.ExposureTick == nil {
+			t.Fatalf("Device state not synced: %#v", stream)
+		}
 	}
 
 	// test trigger arm
@@ -299,12 +309,12 @@ func TestParameterStreaming(t *testing.T) {
 	{
 		go func() {
 			<-time.After(1 * time.Second)
-			err := streamingClient.Send(&mvpulse.ParameterStream{Power: &mvpulse.PowerConfiguration{MasterPower: true}})
+			err := streamingClient.Send(&mvpulse.ParameterStream{RequestId: 1, Power: &mvpulse.PowerConfiguration{MasterPower: true}})
 			if err != nil {
 				t.Fatal(err)
 			}
 		}()
-		stream, err := streamingClient.Recv()
+		stream, err := receiveAck(streamingClient, 1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -315,12 +325,12 @@ func TestParameterStreaming(t *testing.T) {
 	{
 		go func() {
 			<-time.After(1 * time.Second)
-			err := streamingClient.Send(&mvpulse.ParameterStream{Power: &mvpulse.PowerConfiguration{MasterPower: false}})
+			err := streamingClient.Send(&mvpulse.ParameterStream{RequestId: 2, Power: &mvpulse.PowerConfiguration{MasterPower: false}})
 			if err != nil {
 				t.Fatal(err)
 			}
 		}()
-		stream, err := streamingClient.Recv()
+		stream, err := receiveAck(streamingClient, 2)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -334,12 +344,12 @@ func TestParameterStreaming(t *testing.T) {
 	{
 		go func() {
 			<-time.After(1 * time.Second)
-			err := streamingClient.Send(&mvpulse.ParameterStream{Pulse: &mvpulse.PulseConfiguration{ExposureTick: 650}})
+			err := streamingClient.Send(&mvpulse.ParameterStream{RequestId: 3, Pulse: &mvpulse.PulseConfiguration{ExposureTick: 650}})
 			if err != nil {
 				t.Fatal(err)
 			}
 		}()
-		stream, err := streamingClient.Recv()
+		stream, err := receiveAck(streamingClient, 3)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -363,6 +373,45 @@ func TestParameterStreaming(t *testing.T) {
 			t.Fatal("disconnect not received")
 		}
 	}
+
+	// a failed request is acknowledged with its status and the stream stays open
+	t.Log("Test failed request")
+	{
+		err := streamingClient.Send(&mvpulse.ParameterStream{RequestId: 4, Power: &mvpulse.PowerConfiguration{MasterPower: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = receiveAck(streamingClient, 4)
+		if err == nil {
+			t.Fatal("power accepted without a device")
+		}
+		err = streamingClient.Send(&mvpulse.ParameterStream{RequestId: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = receiveAck(streamingClient, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Skip state updates until the acknowledgement of the request arrives. Returns the status of the request as error.
+func receiveAck(stream mvpulse.MicroVisionPulseService_ParameterStreamingClient, requestId uint64) (*mvpulse.ParameterStream, error) {
+	var revision uint64
+	for {
+		message, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if message.Revision < revision {
+			return nil, fmt.Errorf("revision went back from %d to %d", revision, message.Revision)
+		}
+		revision = message.Revision
+		if message.Ack != nil && message.Ack.RequestId == requestId {
+			return message, status.ErrorProto(message.Ack.Status)
+		}
+	}
 }
 
 // boilerplate code
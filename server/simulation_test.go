@@ -0,0 +1,138 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/wuyuanyi135/mvcamctrl/safety"
+	"github.com/wuyuanyi135/mvcamctrl/serial/simulator"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// The service runs end to end against the virtual controllers.
+func TestSimulation(t *testing.T) {
+	config := DefaultConfig()
+	config.Simulate = 2
+	s := NewPulseSericeWithConfig(config)
+	ctx := context.Background()
+
+	devices, err := s.GetDevices(ctx, &mvpulse.GetDevicesReq{Probe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices.Devices) != 2 {
+		t.Fatalf("Expected 2 simulated devices but got %+v", devices.Devices)
+	}
+	for _, device := range devices.Devices {
+		if !device.PulseController || device.HardwareVersion != simulator.HardwareVersion {
+			t.Fatalf("Probe did not find the simulated controller: %+v", device)
+		}
+	}
+
+	_, err = s.Connect(ctx, &mvpulse.ConnectReq{DeviceIdentifier: &mvpulse.ConnectReq_Name{Name: "simulated-pulse-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect(ctx, &mvpulse.DisconnectReq{})
+	if opened := s.State.Snapshot().OpenedDevice; opened == nil || opened.Path != "sim://pulse1" {
+		t.Fatalf("Unexpected opened device %+v", opened)
+	}
+
+	_, err = s.SetPulseParam(ctx, &mvpulse.SetPulseParamReq{
+		Pulse:  &mvpulse.PulseConfiguration{ExposureTick: &wrappers.UInt32Value{Value: 700}},
+		Commit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulse, err := s.GetPulseParam(ctx, &mvpulse.GetPulseParamReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pulse.Pulse.ExposureTick.Value != 700 {
+		t.Fatalf("Expected exposure 700 from the device but got %d", pulse.Pulse.ExposureTick.Value)
+	}
+}
+
+func TestSimulation_DefaultDevicePath(t *testing.T) {
+	config := DefaultConfig()
+	config.Simulate = 1
+	config.DefaultDevice = "sim://pulse0"
+	s := &Server{Service: NewPulseSericeWithConfig(config), config: config}
+
+	s.connectDefaultDevice()
+	defer s.Service.Disconnect(context.Background(), &mvpulse.DisconnectReq{})
+	if opened := s.Service.State.Snapshot().OpenedDevice; opened == nil || opened.Name != "simulated-pulse-0" {
+		t.Fatalf("Default device was not opened by its path: %+v", opened)
+	}
+}
+
+// Without the pulse parameters the safety policy cannot be checked, so the power stays off.
+func TestSimulation_PowerOnWithUnknownParameters(t *testing.T) {
+	config := DefaultConfig()
+	config.Simulate = 1
+	s := NewPulseSericeWithConfig(config)
+	s.Policies = safety.NewPolicies(safety.Policy{MaxExposureTick: 1000})
+	ctx := context.Background()
+	_, err := s.Connect(ctx, &mvpulse.ConnectReq{DeviceIdentifier: &mvpulse.ConnectReq_Name{Name: "simulated-pulse-0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect(ctx, &mvpulse.DisconnectReq{})
+
+	// as after a failed read of the state
+	s.State.Update("status", func(next *StateSnapshot) { next.Config = nil })
+	on := &mvpulse.SetPowerReq{Power: &mvpulse.PowerConfiguration{MasterPower: true}}
+	if _, err := s.SetPower(ctx, on); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition but got %v", err)
+	}
+
+	_, err = s.SetPulseParam(ctx, &mvpulse.SetPulseParamReq{
+		Pulse: &mvpulse.PulseConfiguration{ExposureTick: &wrappers.UInt32Value{Value: 700}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetPower(ctx, on); err != nil {
+		t.Fatalf("Power on with known parameters: %v", err)
+	}
+}
+
+// State-changing calls return the revision they left the state at.
+func TestSimulation_ResponseRevisions(t *testing.T) {
+	config := DefaultConfig()
+	config.Simulate = 1
+	s := NewPulseSericeWithConfig(config)
+	ctx := context.Background()
+
+	connected, err := s.Connect(ctx, &mvpulse.ConnectReq{DeviceIdentifier: &mvpulse.ConnectReq_Name{Name: "simulated-pulse-0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connected.Revision == 0 || connected.Revision != s.State.Snapshot().Revision {
+		t.Fatalf("Connect returned revision %d, the state is at %d", connected.Revision, s.State.Snapshot().Revision)
+	}
+	lease, err := s.AcquireLease(ctx, &mvpulse.AcquireLeaseReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Revision != s.State.Snapshot().Revision {
+		t.Fatalf("AcquireLease returned revision %d, the state is at %d", lease.Revision, s.State.Snapshot().Revision)
+	}
+	released, err := s.ReleaseLease(ctx, &mvpulse.ReleaseLeaseReq{LeaseId: lease.Lease.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released.Revision <= lease.Revision {
+		t.Fatalf("ReleaseLease returned revision %d after %d", released.Revision, lease.Revision)
+	}
+	disconnected, err := s.Disconnect(ctx, &mvpulse.DisconnectReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disconnected.Revision != s.State.Snapshot().Revision {
+		t.Fatalf("Disconnect returned revision %d, the state is at %d", disconnected.Revision, s.State.Snapshot().Revision)
+	}
+}
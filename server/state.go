@@ -0,0 +1,136 @@
+package mvcamctrl
+
+import (
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/olebedev/emitter"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+// State is the server's model of the opened device. It is safe for concurrent use: readers take an immutable
+// Snapshot and writers go through Update, which stores the next revision and notifies the listeners.
+type State struct {
+	mutex    sync.RWMutex
+	snapshot StateSnapshot
+
+	NotifyChanged *emitter.Emitter
+}
+
+// StateSnapshot is the state at one revision. The messages it points to are shared between snapshots and must not be
+// modified; an update replaces them instead.
+type StateSnapshot struct {
+	// Incremented on every change.
+	Revision uint64
+	// Revisions at which Power and Config were last replaced.
+	PowerRevision  uint64
+	ConfigRevision uint64
+
+	Power        *mvpulse.PowerConfiguration
+	Config       *mvpulse.PulseConfiguration
+	Opened       bool
+	TriggerArmed bool
+	OpenedDevice *mvpulse.SerialDevice
+	// The opened device stopped answering the heartbeat.
+	NotResponding bool
+	// Client with exclusive control, if any. It may have expired already; see PulseSerice.currentLease.
+	Lease *Lease
+
+	// Why the server switched the laser off on its own, if it did. Cleared when power is turned on again.
+	PowerOffReason string
+}
+
+func NewState() *State {
+	return &State{
+		NotifyChanged: &emitter.Emitter{},
+	}
+}
+
+func (s *State) Snapshot() StateSnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.snapshot
+}
+
+// Update applies change to a copy of the current state and stores it as the next revision. The listeners of event
+// are notified after the new state is visible.
+func (s *State) Update(event string, change func(next *StateSnapshot)) StateSnapshot {
+	s.mutex.Lock()
+	next := s.snapshot
+	change(&next)
+	next.Revision = s.snapshot.Revision + 1
+	if next.Power != s.snapshot.Power {
+		next.PowerRevision = next.Revision
+	}
+	if next.Config != s.snapshot.Config {
+		next.ConfigRevision = next.Revision
+	}
+	s.snapshot = next
+	s.mutex.Unlock()
+
+	s.NotifyChanged.Emit(event)
+	return next
+}
+
+func (s *State) ParameterStream() *mvpulse.ParameterStream {
+	snapshot := s.Snapshot()
+	return snapshot.ParameterStream()
+}
+
+func (s *State) SetOpened(openedDevice mvpulse.SerialDevice) StateSnapshot {
+	return s.Update("status", func(next *StateSnapshot) {
+		next.OpenedDevice = &openedDevice
+		next.Opened = true
+		next.NotResponding = false
+		next.TriggerArmed = false
+		next.Power = nil
+		next.Config = nil
+	})
+}
+
+func (s *State) SetClosed() StateSnapshot {
+	return s.Update("parameter", func(next *StateSnapshot) {
+		next.OpenedDevice = nil
+		next.Opened = false
+		next.NotResponding = false
+		next.TriggerArmed = false
+		next.Power = nil
+		next.Config = nil
+	})
+}
+
+// Whether the laser may emit: power is on or the trigger is armed.
+func (s *StateSnapshot) Live() bool {
+	return s.TriggerArmed || (s.Power != nil && s.Power.MasterPower)
+}
+
+func (s *StateSnapshot) ParameterStream() *mvpulse.ParameterStream {
+	return &mvpulse.ParameterStream{
+		Revision:       s.Revision,
+		Opened:         s.Opened,
+		TriggerArmed:   s.TriggerArmed,
+		Power:          s.Power,
+		Pulse:          s.Config,
+		PowerOffReason: s.PowerOffReason,
+		NotResponding:  s.NotResponding,
+		Lease:          s.liveLease().proto(false),
+	}
+}
+
+// Optimistic concurrency: fail with Aborted when the value a client edited was changed after the revision it saw.
+// Nothing is checked when the client did not send an expected revision.
+func checkRevision(expected *wrappers.UInt64Value, changed uint64, what string) error {
+	if expected == nil || changed <= expected.Value {
+		return nil
+	}
+	return status.Errorf(codes.Aborted, "the %s changed at revision %d after the expected revision %d",
+		what, changed, expected.Value)
+}
+
+func (s *StateSnapshot) liveLease() *Lease {
+	if s.Lease == nil || s.Lease.expired() {
+		return nil
+	}
+	return s.Lease
+}
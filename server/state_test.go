@@ -0,0 +1,119 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+)
+
+// Run with -race: writers and readers hammer the state while the snapshots must stay consistent.
+func TestState_ConcurrentUpdates(t *testing.T) {
+	state := NewState()
+	state.SetOpened(mvpulse.SerialDevice{Name: "fake", Path: "/dev/null"})
+	start := state.Snapshot().Revision
+
+	const writers = 8
+	const updates = 500
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				if i%2 == 0 {
+					state.Update("status", func(next *StateSnapshot) {
+						next.Power = &mvpulse.PowerConfiguration{MasterPower: i%4 == 0}
+						next.TriggerArmed = !next.TriggerArmed
+					})
+				} else {
+					state.Update("parameter", func(next *StateSnapshot) {
+						next.Config = mergePulse(next.Config, &mvpulse.PulseConfiguration{
+							ExposureTick: &wrappers.UInt32Value{Value: uint32(w*updates + i)},
+						})
+					})
+				}
+			}
+		}(w)
+	}
+
+	stop := make(chan struct{})
+	readerErrors := make(chan string, 1)
+	go func() {
+		var last uint64
+		for {
+			select {
+			case <-stop:
+				close(readerErrors)
+				return
+			default:
+			}
+			snapshot := state.Snapshot()
+			message := snapshot.ParameterStream()
+			if snapshot.Revision < last || message.Revision != snapshot.Revision {
+				readerErrors <- "revision went backwards"
+				close(readerErrors)
+				return
+			}
+			last = snapshot.Revision
+			_ = snapshot.Live()
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	for message := range readerErrors {
+		t.Fatal(message)
+	}
+
+	snapshot := state.Snapshot()
+	if snapshot.Revision != start+writers*updates {
+		t.Fatalf("Expected revision %d but got %d", start+writers*updates, snapshot.Revision)
+	}
+	if !snapshot.Opened || snapshot.OpenedDevice.Name != "fake" {
+		t.Fatalf("Unrelated fields changed: %#v", snapshot)
+	}
+}
+
+func TestState_ExpectedRevision(t *testing.T) {
+	state := NewState()
+	state.SetOpened(mvpulse.SerialDevice{Name: "fake", Path: "/dev/null"})
+	seen := state.Update("parameter", func(next *StateSnapshot) {
+		next.Config = &mvpulse.PulseConfiguration{ExposureTick: &wrappers.UInt32Value{Value: 100}}
+	})
+
+	// changes to other fields do not make the parameters stale
+	state.Update("status", func(next *StateSnapshot) {
+		next.Power = &mvpulse.PowerConfiguration{MasterPower: true}
+	})
+	snapshot := state.Snapshot()
+	if err := checkRevision(&wrappers.UInt64Value{Value: seen.Revision}, snapshot.ConfigRevision, "pulse"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := checkRevision(nil, snapshot.PowerRevision, "power"); err != nil {
+		t.Fatalf("Unexpected error without expected revision: %v", err)
+	}
+
+	state.Update("parameter", func(next *StateSnapshot) {
+		next.Config = mergePulse(next.Config, &mvpulse.PulseConfiguration{PulseDelay: &wrappers.UInt32Value{Value: 5}})
+	})
+	snapshot = state.Snapshot()
+	err := checkRevision(&wrappers.UInt64Value{Value: seen.Revision}, snapshot.ConfigRevision, "pulse")
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted but got %v", err)
+	}
+	if err := checkRevision(&wrappers.UInt64Value{Value: snapshot.Revision}, snapshot.ConfigRevision, "pulse"); err != nil {
+		t.Fatalf("Unexpected error at the current revision: %v", err)
+	}
+}
+
+func TestSetPower_MissingPower(t *testing.T) {
+	s := NewPulseSerice()
+	_, err := s.SetPower(context.Background(), &mvpulse.SetPowerReq{ExpectedRevision: &wrappers.UInt64Value{Value: 1}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument but got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package mvcamctrl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+)
+
+type TLSOptions struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// PEM bundle of the authorities client certificates are verified against. Empty disables client certificates.
+	ClientCAFile string `json:"client_ca_file"`
+	// Reject clients without a valid certificate (mutual TLS). Otherwise a certificate is verified only if presented.
+	RequireClientCert bool `json:"require_client_cert"`
+}
+
+func (o *TLSOptions) ServerCredentials() (credentials.TransportCredentials, error) {
+	config, err := o.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// TLS configuration shared by the gRPC server and the HTTP gateway.
+func (o *TLSOptions) ServerConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %s", err.Error())
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.NoClientCert,
+	}
+
+	if o.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", o.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		if o.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if o.RequireClientCert {
+		return nil, errors.New("client certificates are required but no client CA is configured")
+	}
+
+	return config, nil
+}
@@ -0,0 +1,91 @@
+package mvcamctrl
+
+import (
+	"context"
+	"github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/wuyuanyi135/mvcamctrl/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+var tracer = tracing.Tracer("server")
+
+// Start the server span of a call, continuing the trace of the caller found in carrier.
+func startCallSpan(ctx context.Context, method string, carrier propagation.TextMapCarrier) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+	name := strings.TrimPrefix(method, "/")
+	attributes := []attribute.KeyValue{attribute.String("rpc.system", "grpc")}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		attributes = append(attributes,
+			attribute.String("rpc.service", name[:i]),
+			attribute.String("rpc.method", name[i+1:]),
+		)
+	}
+	if id := requestID(ctx); id != "" {
+		attributes = append(attributes, attribute.String("request_id", id))
+	}
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attributes...))
+}
+
+func endCallSpan(span trace.Span, err error) {
+	code := status.Code(err)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+	if err != nil {
+		span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+	}
+	span.End()
+}
+
+// Trace every call. The spans of the serial transactions made by the handler are children of the call span.
+func TracingUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		ctx, span := startCallSpan(ctx, info.FullMethod, metadataCarrier(md))
+		resp, err := handler(ctx, req)
+		endCallSpan(span, err)
+		return resp, err
+	}
+}
+
+func TracingStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		var span trace.Span
+		wrapped.WrappedContext, span = startCallSpan(ss.Context(), info.FullMethod, metadataCarrier(md))
+		err := handler(srv, wrapped)
+		endCallSpan(span, err)
+		return err
+	}
+}
+
+// Reads the trace context from the incoming gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,263 @@
+package mvcamctrl
+
+import (
+	"net/http"
+)
+
+// Serve the control panel. It talks to the gateway in the same origin, so it is only useful with the gateway enabled.
+func serveWebUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(webUIPage))
+}
+
+// Single page bench control panel. Kept as a string so that the binary stays self-contained.
+const webUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>MicroVision Pulse</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 52em; }
+fieldset { margin-bottom: 1em; }
+label { display: inline-block; min-width: 9em; }
+input[type=number] { width: 8em; }
+#state td { padding: 0.2em 1em 0.2em 0; }
+#error { color: #b00; min-height: 1.2em; }
+#off { background: #d00; color: #fff; font-size: 1.6em; font-weight: bold; padding: 0.6em 2em; border: none;
+       border-radius: 0.3em; cursor: pointer; }
+.live { color: #d00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>MicroVision Pulse</h1>
+<p><button id="off" onclick="powerOff()">POWER OFF</button></p>
+<p id="error"></p>
+
+<fieldset>
+<legend>Access</legend>
+<label for="token">Token</label><input id="token" type="password" size="40" onchange="saveToken()">
+<p>
+<label for="lease">Lease</label><input id="lease" size="34" onchange="saveLease()">
+<button onclick="acquireLease()">Acquire</button>
+<button onclick="releaseLease()">Release</button>
+</p>
+</fieldset>
+
+<fieldset>
+<legend>Device</legend>
+<select id="devices"></select>
+<button onclick="listDevices()">Refresh</button>
+<button onclick="listDevices(true)">Probe</button>
+<button onclick="connect()">Connect</button>
+<button onclick="call('Disconnect', {})">Disconnect</button>
+</fieldset>
+
+<fieldset>
+<legend>State</legend>
+<table id="state">
+<tr><td>Opened</td><td id="opened">-</td></tr>
+<tr><td>Power</td><td id="power">-</td></tr>
+<tr><td>Trigger</td><td id="armed">-</td></tr>
+<tr><td>Exposure tick</td><td id="exposure">-</td></tr>
+<tr><td>Pulse delay</td><td id="delay">-</td></tr>
+<tr><td>Digital filter</td><td id="filter">-</td></tr>
+<tr><td>Polarity</td><td id="polarity">-</td></tr>
+<tr><td>Power-off reason</td><td id="reason">-</td></tr>
+<tr><td>Controlled by</td><td id="holder">-</td></tr>
+</table>
+</fieldset>
+
+<fieldset>
+<legend>Control</legend>
+<p>
+<button onclick="call('SetPower', {power: {masterPower: true}})">Power on</button>
+<button onclick="call('SetTriggerArm', {armTrigger: true})">Arm trigger</button>
+<button onclick="call('SetTriggerArm', {armTrigger: false})">Disarm trigger</button>
+</p>
+<p><label for="set-exposure">Exposure tick</label><input id="set-exposure" type="number" min="0" oninput="editing()"></p>
+<p><label for="set-delay">Pulse delay</label><input id="set-delay" type="number" min="0" oninput="editing()"></p>
+<p><label for="set-filter">Digital filter</label><input id="set-filter" type="number" min="0" oninput="editing()"></p>
+<p><label for="set-polarity">Inverted polarity</label><input id="set-polarity" type="checkbox" onchange="editing(); polarityEdited = true"></p>
+<p><button onclick="setParameters()">Apply and commit</button></p>
+</fieldset>
+
+<script>
+var tokenInput = document.getElementById("token");
+tokenInput.value = localStorage.getItem("mvpulse-token") || "";
+
+function saveToken() {
+  localStorage.setItem("mvpulse-token", tokenInput.value);
+  watch();
+}
+
+var leaseInput = document.getElementById("lease");
+leaseInput.value = sessionStorage.getItem("mvpulse-lease") || "";
+
+function saveLease() {
+  sessionStorage.setItem("mvpulse-lease", leaseInput.value);
+}
+
+function acquireLease() {
+  call("AcquireLease", {owner: "web"}).then(function (content) {
+    leaseInput.value = content.lease.id;
+    saveLease();
+  });
+}
+
+function releaseLease() {
+  call("ReleaseLease", {leaseId: leaseInput.value}).then(function () {
+    leaseInput.value = "";
+    saveLease();
+  });
+}
+
+function showError(message) {
+  document.getElementById("error").textContent = message || "";
+}
+
+function call(method, body) {
+  var headers = {"Content-Type": "application/json"};
+  if (tokenInput.value) {
+    headers["Authorization"] = "Bearer " + tokenInput.value;
+  }
+  if (leaseInput.value) {
+    headers["X-Lease-Id"] = leaseInput.value;
+  }
+  return fetch("/api/" + method, {method: "POST", headers: headers, body: JSON.stringify(body)})
+    .then(function (response) {
+      return response.json().then(function (content) {
+        if (!response.ok) {
+          throw new Error(method + ": " + (content.message || response.statusText));
+        }
+        showError("");
+        return content;
+      });
+    })
+    .catch(function (err) {
+      showError(err.message);
+      throw err;
+    });
+}
+
+function powerOff() {
+  // disarm even if switching the power off fails
+  call("SetPower", {power: {masterPower: false}}).finally(function () {
+    call("SetTriggerArm", {armTrigger: false});
+  });
+}
+
+function listDevices(probe) {
+  call("GetDevices", {probe: !!probe}).then(function (content) {
+    var select = document.getElementById("devices");
+    select.innerHTML = "";
+    (content.devices || []).forEach(function (device) {
+      var option = document.createElement("option");
+      option.value = device.path;
+      option.textContent = (device.product ? device.product + " " + device.serialNumber + " - " : "") + device.name + " (" + device.path + ")";
+      if (device.pulseController) {
+        option.textContent += " - pulse controller v" + device.hardwareVersion + "/" + device.firmwareVersion;
+      } else if (device.probed || device.probeError) {
+        option.textContent += " - not a pulse controller";
+        option.disabled = !device.opened;
+      }
+      select.appendChild(option);
+    });
+  });
+}
+
+function connect() {
+  var path = document.getElementById("devices").value;
+  if (path) {
+    call("Connect", {path: path});
+  }
+}
+
+function optionalNumber(id) {
+  var value = document.getElementById(id).value;
+  return value === "" ? undefined : Number(value);
+}
+
+// Revision of the state shown when the user started editing the parameters. Applying fails if another client
+// changed them since.
+var revision = 0;
+var editRevision = null;
+// The checkbox has no empty state, so the polarity is only sent once it was changed.
+var polarityEdited = false;
+function editing() {
+  if (editRevision === null) {
+    editRevision = revision;
+  }
+}
+
+function setParameters() {
+  var expected = editRevision === null ? revision : editRevision;
+  var polarity = polarityEdited ? document.getElementById("set-polarity").checked : undefined;
+  editRevision = null;
+  polarityEdited = false;
+  call("SetPulseParam", {
+    pulse: {
+      exposureTick: optionalNumber("set-exposure"),
+      pulseDelay: optionalNumber("set-delay"),
+      digitalFilter: optionalNumber("set-filter"),
+      polarity: polarity
+    },
+    commit: true,
+    expectedRevision: expected
+  });
+}
+
+function show(id, value, live) {
+  var cell = document.getElementById(id);
+  cell.textContent = value === undefined || value === null || value === "" ? "-" : String(value);
+  cell.className = live ? "live" : "";
+}
+
+function render(state) {
+  revision = Number(state.revision || 0);
+  var power = state.power || {};
+  var pulse = state.pulse || {};
+  show("opened", state.opened ? (state.notResponding ? "yes, not responding" : "yes") : "no");
+  show("power", state.power ? (power.masterPower ? "ON" : "off") : undefined, power.masterPower);
+  show("armed", state.triggerArmed ? "ARMED" : "disarmed", state.triggerArmed);
+  show("exposure", pulse.exposureTick);
+  show("delay", pulse.pulseDelay);
+  show("filter", pulse.digitalFilter);
+  show("polarity", pulse.polarity === undefined ? undefined : (pulse.polarity ? "inverted" : "normal"));
+  if (!polarityEdited) {
+    document.getElementById("set-polarity").checked = !!pulse.polarity;
+  }
+  show("reason", state.powerOffReason);
+  show("holder", state.lease ? state.lease.holder + " until " + new Date(state.lease.expires).toLocaleTimeString() : undefined);
+}
+
+var events = null;
+function watch() {
+  if (events) {
+    events.close();
+  }
+  var url = "/api/ParameterStreaming";
+  if (tokenInput.value) {
+    url += "?access_token=" + encodeURIComponent(tokenInput.value);
+  }
+  events = new EventSource(url);
+  events.onmessage = function (event) {
+    render(JSON.parse(event.data));
+  };
+  events.onerror = function () {
+    showError("Lost the state stream, reconnecting...");
+  };
+  events.onopen = function () {
+    showError("");
+  };
+}
+
+listDevices();
+watch();
+</script>
+</body>
+</html>
+`
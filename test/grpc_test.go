@@ -3,8 +3,7 @@ package test
 import (
 	"context"
 	"fmt"
-	"github.com/golang/protobuf/ptypes/empty"
-	"github.com/wuyuanyi135/mvcamctrl/protos"
+	"github.com/wuyuanyi135/mvprotos/mvpulse"
 	"google.golang.org/grpc"
 	"testing"
 )
@@ -14,11 +13,15 @@ func TestGetSerialList(t *testing.T) {
 	if err != nil {
 		panic("Failed to connect to server")
 	}
+	defer conn.Close()
 
-	client := laserctrlgrpc.NewLaserControlServiceClient(conn)
-	response, err := client.GetSerialDevices(context.Background(), &empty.Empty{})
-	fmt.Printf("There are %d serial devices\n", len(response.DeviceList))
-	for i, element := range response.DeviceList {
-		fmt.Printf("#%d: %s=>%s\n", i, element.Name, element.Destination)
+	client := mvpulse.NewMicroVisionPulseServiceClient(conn)
+	response, err := client.GetDevices(context.Background(), &mvpulse.GetDevicesReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("There are %d serial devices\n", len(response.Devices))
+	for i, element := range response.Devices {
+		fmt.Printf("#%d: %s=>%s\n", i, element.Name, element.Path)
 	}
 }
@@ -0,0 +1,101 @@
+// Package tracing sets up OpenTelemetry tracing for the daemon. Spans are exported over OTLP/gRPC or written to stdout,
+// and W3C trace context is propagated from the callers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"strings"
+)
+
+const (
+	ExporterNone   = ""
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+
+	DefaultServiceName = "mvpulse"
+)
+
+// Attribute keys of the serial transactions.
+const (
+	AttributeDevice  = attribute.Key("serial.device")
+	AttributeOpcode  = attribute.Key("serial.opcode")
+	AttributePending = attribute.Key("serial.pending")
+)
+
+type Config struct {
+	// "otlp", "stdout", or empty to disable tracing.
+	Exporter string `json:"exporter"`
+	// OTLP/gRPC collector such as localhost:4317 or http://localhost:4317. Empty uses OTEL_EXPORTER_OTLP_ENDPOINT or
+	// the OTLP default.
+	Endpoint string `json:"endpoint"`
+	// Connect to the collector without TLS.
+	Insecure bool `json:"insecure"`
+	// Fraction of the traces started here that are sampled, 0 to 1. Zero samples every trace. Traces started by a
+	// caller follow the caller's decision.
+	SampleRatio float64 `json:"sample_ratio"`
+	ServiceName string  `json:"service_name"`
+}
+
+// Tracer of a package of the daemon.
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer("github.com/wuyuanyi135/mvcamctrl/" + name)
+}
+
+// Setup installs the global tracer provider and propagator. The returned function flushes the pending spans and
+// shuts the exporter down. With tracing disabled both are no-ops.
+func Setup(config Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(config.Exporter) {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		var options []otlptracegrpc.Option
+		if strings.Contains(config.Endpoint, "://") {
+			// http:// connects without TLS
+			options = append(options, otlptracegrpc.WithEndpointURL(config.Endpoint))
+		} else if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		// connects in the background, so a collector that is down does not stop the daemon
+		exporter, err = otlptracegrpc.New(context.Background(), options...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %s", config.Exporter, err.Error())
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	sampler := sdktrace.AlwaysSample()
+	if config.SampleRatio > 0 && config.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(config.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}